@@ -0,0 +1,107 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync/atomic"
+)
+
+// Batch collects a number of calls to be sent together with Execute. When
+// used with a buffered MsgpackCodec all the requests are written with a
+// single flush, which amortizes the cost of the flush over many small calls.
+type Batch struct {
+	calls []batchCall
+}
+
+type batchCall struct {
+	method string
+	args   interface{}
+	resp   interface{}
+}
+
+// Result is the outcome of a single call made as part of a Batch.
+type Result struct {
+	// Method is the service method that was called.
+	Method string
+
+	// Error is the error returned by the server for this call, if any.
+	Error error
+}
+
+// Add queues a call to the given method. The response is decoded into resp
+// when the batch is executed.
+func (b *Batch) Add(method string, args interface{}, resp interface{}) {
+	b.calls = append(b.calls, batchCall{method: method, args: args, resp: resp})
+}
+
+// Len returns the number of calls queued in the batch.
+func (b *Batch) Len() int {
+	return len(b.calls)
+}
+
+// Execute writes all the queued calls to the codec and then reads all of the
+// responses, returning a Result for each call in the order they were added.
+//
+// net/rpc servers handle each request in its own goroutine, so responses
+// may arrive in any order. They are matched back to their calls using the
+// sequence number. As with CallWithCodec, the codec must not be shared with
+// other concurrent RPCs, and it is closed if reading a response fails.
+func (b *Batch) Execute(cc rpc.ClientCodec) ([]Result, error) {
+	reqs := make([]rpc.Request, len(b.calls))
+	bodies := make([]interface{}, len(b.calls))
+	pending := make(map[uint64]int, len(b.calls))
+	for i, call := range b.calls {
+		reqs[i] = rpc.Request{
+			Seq:           atomic.AddUint64(&nextCallSeq, 1),
+			ServiceMethod: call.method,
+		}
+		bodies[i] = call.args
+		pending[reqs[i].Seq] = i
+	}
+
+	if mc, ok := cc.(*MsgpackCodec); ok {
+		if err := mc.writeRequests(reqs, bodies); err != nil {
+			return nil, err
+		}
+	} else {
+		for i := range reqs {
+			if err := cc.WriteRequest(&reqs[i], bodies[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	results := make([]Result, len(b.calls))
+	for len(pending) > 0 {
+		var response rpc.Response
+		if err := cc.ReadResponseHeader(&response); err != nil {
+			cc.Close()
+			return nil, err
+		}
+		i, ok := pending[response.Seq]
+		if !ok {
+			cc.Close()
+			return nil, fmt.Errorf("unexpected response sequence number %d", response.Seq)
+		}
+		delete(pending, response.Seq)
+
+		call := b.calls[i]
+		results[i].Method = call.method
+		if response.Error != "" {
+			results[i].Error = rpc.ServerError(response.Error)
+			if err := cc.ReadResponseBody(nil); err != nil {
+				cc.Close()
+				return nil, err
+			}
+			continue
+		}
+		if err := cc.ReadResponseBody(call.resp); err != nil {
+			cc.Close()
+			return nil, err
+		}
+	}
+	return results, nil
+}
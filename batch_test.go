@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"fmt"
+	"net/rpc"
+	"testing"
+)
+
+func TestBatch_Execute(t *testing.T) {
+	cc := testServer(t)
+
+	var b Batch
+	resps := make([]string, 10)
+	for i := range resps {
+		if i == 5 {
+			b.Add("TestService.Fail", "boom", &resps[i])
+			continue
+		}
+		b.Add("TestService.Echo", fmt.Sprintf("hello %d", i), &resps[i])
+	}
+
+	results, err := b.Execute(cc)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(results) != b.Len() {
+		t.Fatalf("bad: %d results", len(results))
+	}
+	for i, res := range results {
+		if i == 5 {
+			if _, ok := res.Error.(rpc.ServerError); !ok || res.Error.Error() != "boom" {
+				t.Fatalf("bad: %#v", res.Error)
+			}
+			continue
+		}
+		if res.Error != nil {
+			t.Fatalf("err: %v", res.Error)
+		}
+		if expected := fmt.Sprintf("hello %d", i); resps[i] != expected {
+			t.Fatalf("bad: %q != %q", resps[i], expected)
+		}
+	}
+}
+
+func TestBatch_Execute_WriteError(t *testing.T) {
+	// A body that fails to encode sends none of the batch.
+	conn := &bufConn{}
+	cc := NewCodec(true, true, conn)
+	var b Batch
+	var out string
+	b.Add("TestService.Echo", "hello", &out)
+	b.Add("TestService.Echo", complex(1, 2), &out)
+	if _, err := b.Execute(cc); err == nil {
+		t.Fatalf("expected error")
+	}
+	if conn.w.Len() != 0 || cc.IsClosed() {
+		t.Fatalf("expected nothing written")
+	}
+
+	// A failed write closes the codec.
+	failing := &failingWriteConn{}
+	cc = NewCodec(true, true, failing)
+	b = Batch{}
+	b.Add("TestService.Echo", "hello", &out)
+	if _, err := b.Execute(cc); err == nil || err.Error() != "write failed" {
+		t.Fatalf("bad: %v", err)
+	}
+	if !cc.IsClosed() || !failing.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+}
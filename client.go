@@ -5,8 +5,10 @@ package msgpackrpc
 
 import (
 	"errors"
+	"io"
 	"net/rpc"
 	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 )
@@ -15,12 +17,152 @@ var (
 	// nextCallSeq is used to assign a unique sequence number
 	// to each call made with CallWithCodec
 	nextCallSeq uint64
+
+	// ErrConcurrentCall is returned by a CallerSeq with DetectConcurrent
+	// set if a call is started while another is still in progress.
+	ErrConcurrentCall = errors.New("msgpackrpc: concurrent call on a codec that requires serial use")
+
+	// ErrResponseMismatch is returned by a CallerSeq with CheckResponse set
+	// if a response doesn't match the request it was read for.
+	ErrResponseMismatch = errors.New("msgpackrpc: response does not match request")
+
+	// ErrAborted is returned by CallWithCodecDone if the call was aborted.
+	ErrAborted = errors.New("msgpackrpc: call aborted")
 )
 
 // CallWithCodec is used to perform the same actions as rpc.Client.Call but
 // in a much cheaper way. It assumes the underlying connection is not being
 // shared with multiple concurrent RPCs. The request/response must be syncronous.
+//
+// If reading the response fails, the codec is closed since the stream may
+// be left part way through a message and can't safely be reused.
 func CallWithCodec(cc rpc.ClientCodec, method string, args interface{}, resp interface{}) error {
+	request := rpc.Request{
+		Seq:           atomic.AddUint64(&nextCallSeq, 1),
+		ServiceMethod: method,
+	}
+	return callWithCodec(nil, cc, &request, args, resp)
+}
+
+// CallWithCodecReq is the same as CallWithCodec, but uses the caller
+// provided req rather than allocating a new one for each call. The method
+// and next sequence number are set on req before it is written. This saves
+// an allocation per call on hot paths.
+func CallWithCodecReq(cc rpc.ClientCodec, req *rpc.Request, method string, args interface{}, resp interface{}) error {
+	req.Seq = atomic.AddUint64(&nextCallSeq, 1)
+	req.ServiceMethod = method
+	return callWithCodec(nil, cc, req, args, resp)
+}
+
+// CallWithCodecTimeout is the same as CallWithCodec, but fails with a
+// timeout error if the response hasn't been read within timeout. The codec is
+// closed on timeout, since the response may still arrive later. The timeout
+// is applied as a read deadline on the connection, so it only has an effect
+// for a MsgpackCodec whose connection supports deadlines, such as a
+// net.Conn.
+func CallWithCodecTimeout(cc rpc.ClientCodec, method string, args interface{}, resp interface{}, timeout time.Duration) error {
+	if c, ok := cc.(interface{ IsClosed() bool }); ok && c.IsClosed() {
+		// Setting a deadline on the closed connection would fail with an
+		// error from the connection rather than io.EOF.
+		return io.EOF
+	}
+	if dc, ok := cc.(interface{ connReadDeadliner() readDeadliner }); ok {
+		if d := dc.connReadDeadliner(); d != nil {
+			if err := d.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+				return err
+			}
+			defer d.SetReadDeadline(time.Time{})
+		}
+	}
+	return CallWithCodec(cc, method, args, resp)
+}
+
+// CallWithCodecDone is the same as CallWithCodec, but aborts the call if
+// done is closed before it completes, for code that signals shutdown with a
+// channel rather than a context. The codec is closed to unblock the call,
+// and ErrAborted is returned.
+func CallWithCodecDone(done <-chan struct{}, cc rpc.ClientCodec, method string, args, resp interface{}) error {
+	return callWithDone(done, func() error { return ErrAborted }, cc, method, args, resp)
+}
+
+// callWithDone makes a call with CallWithCodec, aborting it if done is
+// closed first and returning the error from abortErr.
+func callWithDone(done <-chan struct{}, abortErr func() error, cc rpc.ClientCodec, method string, args, resp interface{}) error {
+	return abortOnDone(done, abortErr, cc, func() error {
+		return CallWithCodec(cc, method, args, resp)
+	})
+}
+
+// abortOnDone runs call, closing cc to unblock it if done is closed before
+// it returns. If the call was aborted, the error from abortErr is returned.
+func abortOnDone(done <-chan struct{}, abortErr func() error, cc rpc.ClientCodec, call func() error) error {
+	select {
+	case <-done:
+		return abortErr()
+	default:
+	}
+
+	var aborted atomic.Bool
+	stopCh := make(chan struct{})
+	exitCh := make(chan struct{})
+	go func() {
+		defer close(exitCh)
+		select {
+		case <-done:
+			aborted.Store(true)
+			cc.Close()
+		case <-stopCh:
+		}
+	}()
+
+	err := call()
+	close(stopCh)
+	<-exitCh
+	if aborted.Load() {
+		return abortErr()
+	}
+	return err
+}
+
+// CallWithCodecPooled is the same as CallWithCodec, but decodes the response
+// into an object taken from get, such as a sync.Pool's Get, and returns it.
+// On success the caller owns the object and is responsible for returning it
+// to the pool. On error the object is passed to put and nil is returned.
+func CallWithCodecPooled(cc rpc.ClientCodec, method string, args interface{}, get func() interface{}, put func(interface{})) (interface{}, error) {
+	resp := get()
+	if err := CallWithCodec(cc, method, args, resp); err != nil {
+		put(resp)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// CallWithCodecSized is the same as CallWithCodec, but also returns the
+// number of bytes the request took on the wire, and the number read for the
+// response, header and body included. This allows size histograms to be
+// kept per method. The sizes are only known for a MsgpackCodec, and are
+// zero for other codecs.
+func CallWithCodecSized(cc rpc.ClientCodec, method string, args, resp interface{}) (reqBytes, respBytes int, err error) {
+	counter, _ := cc.(interface{ byteCounts() (int, int) })
+	var read, written int
+	if counter != nil {
+		read, written = counter.byteCounts()
+	}
+	err = CallWithCodec(cc, method, args, resp)
+	if counter != nil {
+		readAfter, writtenAfter := counter.byteCounts()
+		reqBytes, respBytes = writtenAfter-written, readAfter-read
+	}
+	return reqBytes, respBytes, err
+}
+
+// CallWithCodecDynamic is the same as CallWithCodec, but chooses the type
+// to decode the response body into once the response header has been read.
+// pick is called with the header of a successful response and returns the
+// object to decode the body into, which lets a method return different types
+// without a second round trip. If pick returns nil, the body is skipped.
+// pick is not called for an error response.
+func CallWithCodecDynamic(cc rpc.ClientCodec, method string, args interface{}, pick func(rpc.Response) interface{}) error {
 	request := rpc.Request{
 		Seq:           atomic.AddUint64(&nextCallSeq, 1),
 		ServiceMethod: method,
@@ -28,18 +170,153 @@ func CallWithCodec(cc rpc.ClientCodec, method string, args interface{}, resp int
 	if err := cc.WriteRequest(&request, args); err != nil {
 		return err
 	}
+
 	var response rpc.Response
 	if err := cc.ReadResponseHeader(&response); err != nil {
+		cc.Close()
 		return err
 	}
+	var resp interface{}
+	if response.Error == "" {
+		resp = pick(response)
+	}
+	return readResponseRest(nil, cc, &request, &response, resp)
+}
+
+// SeqSource provides sequence numbers for a CallerSeq. It must be safe for
+// concurrent use and shouldn't repeat numbers on a single connection.
+type SeqSource interface {
+	Next() uint64
+}
+
+// CallerSeq is used to make calls like CallWithCodec, but with sequence
+// numbers taken from its own counter rather than the process wide one. This
+// makes the sequence numbers predictable, which is useful in tests and for
+// keeping them aligned with a single connection. The zero value is ready to
+// use, and its first call uses sequence number 1.
+type CallerSeq struct {
+	seq uint64
+
+	// Source, if set, provides the sequence numbers instead of the
+	// CallerSeq's own counter. This allows them to be correlated with an
+	// external system, such as a tracing ID generator.
+	Source SeqSource
+
+	// DetectConcurrent makes CallWithCodec return ErrConcurrentCall if it
+	// is called while another call is still in progress. Since the codec
+	// can't be shared by concurrent calls, this turns a corrupted stream
+	// into a clear error during development.
+	DetectConcurrent bool
+	inProgress       int32
+
+	// ErrorDecoder, if set, is used to turn the error string sent by the
+	// server into the error returned from CallWithCodec. DecodeError can be
+	// used here to receive errors sent with EncodeError. By default an
+	// rpc.ServerError is returned.
+	ErrorDecoder func(msg string) error
+
+	// CheckResponse makes CallWithCodec verify that the method and
+	// sequence number of each response match those of the request. If
+	// they don't, the codec is closed and ErrResponseMismatch is returned,
+	// rather than decoding the body into the wrong type. This catches a
+	// desynchronized stream or a server routing bug immediately. It is off
+	// by default, since not every server echoes the method.
+	CheckResponse bool
+}
+
+// NewCallerSeq returns a CallerSeq whose first call uses the given sequence
+// number. A next of 0 is treated as 1, the same as the zero CallerSeq, since
+// the counter can't start below zero.
+func NewCallerSeq(next uint64) *CallerSeq {
+	if next == 0 {
+		next = 1
+	}
+	return &CallerSeq{seq: next - 1}
+}
+
+// NewCallerSeqFromSource returns a CallerSeq that takes its sequence
+// numbers from src.
+func NewCallerSeqFromSource(src SeqSource) *CallerSeq {
+	return &CallerSeq{Source: src}
+}
+
+// Next returns the next sequence number.
+func (c *CallerSeq) Next() uint64 {
+	if c.Source != nil {
+		return c.Source.Next()
+	}
+	return atomic.AddUint64(&c.seq, 1)
+}
+
+// Reset sets the counter back to zero, so the next call uses sequence
+// number 1. This is intended for when a new connection is made, so the
+// sequence numbers line up with the physical connection. Resetting while a
+// connection is in use can reuse sequence numbers the server has already
+// seen, which breaks any server logic that relies on them being unique. It
+// has no effect on a Source.
+func (c *CallerSeq) Reset() {
+	atomic.StoreUint64(&c.seq, 0)
+}
+
+// CallWithCodec is the same as the package level CallWithCodec, but uses the
+// next sequence number from c.
+func (c *CallerSeq) CallWithCodec(cc rpc.ClientCodec, method string, args interface{}, resp interface{}) error {
+	if c.DetectConcurrent {
+		if !atomic.CompareAndSwapInt32(&c.inProgress, 0, 1) {
+			return ErrConcurrentCall
+		}
+		defer atomic.StoreInt32(&c.inProgress, 0)
+	}
+	request := rpc.Request{
+		Seq:           c.Next(),
+		ServiceMethod: method,
+	}
+	return callWithCodec(c, cc, &request, args, resp)
+}
+
+// callWithCodec makes a call using the given request. The options on c are
+// applied if it is not nil.
+func callWithCodec(c *CallerSeq, cc rpc.ClientCodec, request *rpc.Request, args interface{}, resp interface{}) error {
+	if err := cc.WriteRequest(request, args); err != nil {
+		return err
+	}
+	return readResponse(c, cc, request, resp)
+}
+
+// readResponse reads the response to request into resp. The options on c
+// are applied if it is not nil.
+func readResponse(c *CallerSeq, cc rpc.ClientCodec, request *rpc.Request, resp interface{}) error {
+	var response rpc.Response
+	if err := cc.ReadResponseHeader(&response); err != nil {
+		cc.Close()
+		return err
+	}
+	return readResponseRest(c, cc, request, &response, resp)
+}
+
+// readResponseRest reads the body of the response to request, whose header
+// has already been read into response, into resp. The options on c are
+// applied if it is not nil.
+func readResponseRest(c *CallerSeq, cc rpc.ClientCodec, request *rpc.Request, response *rpc.Response, resp interface{}) error {
+	if c != nil && c.CheckResponse &&
+		(response.ServiceMethod != request.ServiceMethod || response.Seq != request.Seq) {
+		cc.Close()
+		return ErrResponseMismatch
+	}
 	if response.Error != "" {
 		err := errors.New(response.Error)
 		if readErr := cc.ReadResponseBody(nil); readErr != nil {
+			cc.Close()
 			err = multierror.Append(err, readErr)
+			return rpc.ServerError(err.Error())
+		}
+		if c != nil && c.ErrorDecoder != nil {
+			return c.ErrorDecoder(response.Error)
 		}
 		return rpc.ServerError(err.Error())
 	}
 	if err := cc.ReadResponseBody(resp); err != nil {
+		cc.Close()
 		return err
 	}
 	return nil
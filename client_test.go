@@ -0,0 +1,586 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+func TestCallWithCodec_TruncatedBody(t *testing.T) {
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf, msgpackHandle)
+	if err := enc.Encode(&rpc.Response{ServiceMethod: "Test.Echo", Seq: 1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := enc.Encode("hello world"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf.Truncate(buf.Len() - 4)
+
+	conn := &bufConn{r: &buf}
+	cc := NewCodec(true, true, conn)
+
+	var out string
+	if err := CallWithCodec(cc, "Test.Echo", "hello world", &out); err == nil {
+		t.Fatalf("expected error")
+	}
+	if !cc.IsClosed() {
+		t.Fatalf("expected codec to be closed")
+	}
+	if !conn.closed {
+		t.Fatalf("expected conn to be closed")
+	}
+}
+
+func TestCallerSeq(t *testing.T) {
+	cc := testServer(t)
+	seqs := &recordingCodec{ClientCodec: cc}
+
+	caller := NewCallerSeq(100)
+	for i := 0; i < 3; i++ {
+		var resp string
+		if err := caller.CallWithCodec(seqs, "TestService.Echo", "hello", &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(seqs.seqs, []uint64{100, 101, 102}) {
+		t.Fatalf("bad: %v", seqs.seqs)
+	}
+}
+
+func TestNewCallerSeq_Zero(t *testing.T) {
+	if seq := NewCallerSeq(0).Next(); seq != 1 {
+		t.Fatalf("bad: %d", seq)
+	}
+	if seq := new(CallerSeq).Next(); seq != 1 {
+		t.Fatalf("bad: %d", seq)
+	}
+}
+
+func TestCallerSeq_Reset(t *testing.T) {
+	seqs := &recordingCodec{ClientCodec: testServer(t)}
+	caller := NewCallerSeq(100)
+	var resp string
+	for i := 0; i < 2; i++ {
+		if err := caller.CallWithCodec(seqs, "TestService.Echo", "hello", &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// After a reset, numbering starts again from 1.
+	caller.Reset()
+	if err := caller.CallWithCodec(seqs, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if seq := caller.Next(); seq != 2 {
+		t.Fatalf("bad: %d", seq)
+	}
+	if !reflect.DeepEqual(seqs.seqs, []uint64{100, 101, 1}) {
+		t.Fatalf("bad: %v", seqs.seqs)
+	}
+
+	// A Source is unaffected.
+	caller = NewCallerSeqFromSource(&fakeSource{seqs: []uint64{7, 8}})
+	if seq := caller.Next(); seq != 7 {
+		t.Fatalf("bad: %d", seq)
+	}
+	caller.Reset()
+	if seq := caller.Next(); seq != 8 {
+		t.Fatalf("bad: %d", seq)
+	}
+}
+
+func TestCallerSeq_DetectConcurrent(t *testing.T) {
+	cc := &blockingCodec{
+		ClientCodec: testServer(t),
+		entered:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	caller := &CallerSeq{DetectConcurrent: true}
+
+	errCh := make(chan error, 1)
+	go func() {
+		var resp string
+		errCh <- caller.CallWithCodec(cc, "TestService.Echo", "first", &resp)
+	}()
+	<-cc.entered
+
+	// The first call is still writing its request.
+	var resp string
+	if err := caller.CallWithCodec(cc, "TestService.Echo", "second", &resp); err != ErrConcurrentCall {
+		t.Fatalf("bad: %v", err)
+	}
+
+	close(cc.release)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Once it's done, calls are allowed again.
+	go func() { <-cc.entered }()
+	if err := caller.CallWithCodec(cc, "TestService.Echo", "third", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "third" {
+		t.Fatalf("bad: %q", resp)
+	}
+}
+
+// recordingCodec records the sequence number of each request written.
+type recordingCodec struct {
+	rpc.ClientCodec
+	seqs []uint64
+}
+
+func (c *recordingCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	c.seqs = append(c.seqs, r.Seq)
+	return c.ClientCodec.WriteRequest(r, body)
+}
+
+// blockingCodec holds each request in WriteRequest until it is released,
+// signalling on entered when a request arrives.
+type blockingCodec struct {
+	rpc.ClientCodec
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	c.entered <- struct{}{}
+	<-c.release
+	return c.ClientCodec.WriteRequest(r, body)
+}
+
+// nopCodec is a ClientCodec that doesn't touch the wire, so benchmarks only
+// measure the cost of the call itself.
+type nopCodec struct{}
+
+func (nopCodec) WriteRequest(*rpc.Request, interface{}) error { return nil }
+func (nopCodec) ReadResponseHeader(*rpc.Response) error       { return nil }
+func (nopCodec) ReadResponseBody(interface{}) error           { return nil }
+func (nopCodec) Close() error                                 { return nil }
+
+func BenchmarkCallWithCodec(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := CallWithCodec(nopCodec{}, "Test.Method", nil, nil); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestCallWithCodecReq(t *testing.T) {
+	cc := testServer(t)
+
+	// The same req is reused for each call, and updated for it.
+	var req rpc.Request
+	var out string
+	if err := CallWithCodecReq(cc, &req, "TestService.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" || req.ServiceMethod != "TestService.Echo" {
+		t.Fatalf("bad: %q %v", out, req)
+	}
+	first := req.Seq
+
+	var failed string
+	err := CallWithCodecReq(cc, &req, "TestService.Fail", "boom", &failed)
+	if err != rpc.ServerError("boom") {
+		t.Fatalf("bad: %v", err)
+	}
+	if req.ServiceMethod != "TestService.Fail" || req.Seq <= first {
+		t.Fatalf("bad: %v", req)
+	}
+
+	if err := CallWithCodecReq(cc, &req, "TestService.Echo", "world", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "world" || req.ServiceMethod != "TestService.Echo" {
+		t.Fatalf("bad: %q %v", out, req)
+	}
+}
+
+func BenchmarkCallWithCodecReq(b *testing.B) {
+	b.ReportAllocs()
+	var req rpc.Request
+	for i := 0; i < b.N; i++ {
+		if err := CallWithCodecReq(nopCodec{}, &req, "Test.Method", nil, nil); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+// fakeSource hands out sequence numbers from a fixed list.
+type fakeSource struct {
+	seqs []uint64
+}
+
+func (s *fakeSource) Next() uint64 {
+	seq := s.seqs[0]
+	s.seqs = s.seqs[1:]
+	return seq
+}
+
+func TestCallerSeq_Source(t *testing.T) {
+	cc := testServer(t)
+	seqs := &recordingCodec{ClientCodec: cc}
+
+	expected := []uint64{42, 7, 1 << 40}
+	caller := NewCallerSeqFromSource(&fakeSource{seqs: append([]uint64(nil), expected...)})
+	for range expected {
+		var resp string
+		if err := caller.CallWithCodec(seqs, "TestService.Echo", "hello", &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(seqs.seqs, expected) {
+		t.Fatalf("bad: %v", seqs.seqs)
+	}
+}
+
+func TestCallWithCodecPooled(t *testing.T) {
+	cc := testServer(t)
+
+	var gets, puts int
+	get := func() interface{} {
+		gets++
+		return new(string)
+	}
+	put := func(interface{}) { puts++ }
+
+	resp, err := CallWithCodecPooled(cc, "TestService.Echo", "hello", get, put)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if *resp.(*string) != "hello" {
+		t.Fatalf("bad: %v", *resp.(*string))
+	}
+	if gets != 1 || puts != 0 {
+		t.Fatalf("bad: gets %d puts %d", gets, puts)
+	}
+
+	resp, err = CallWithCodecPooled(cc, "TestService.Fail", "boom", get, put)
+	if err == nil || err.Error() != "boom" {
+		t.Fatalf("bad: %v", err)
+	}
+	if resp != nil {
+		t.Fatalf("bad: %v", resp)
+	}
+	if gets != 2 || puts != 1 {
+		t.Fatalf("bad: gets %d puts %d", gets, puts)
+	}
+}
+
+func TestCallerSeq_CheckResponse(t *testing.T) {
+	responses := func(resps ...rpc.Response) *bytes.Buffer {
+		var buf bytes.Buffer
+		enc := codec.NewEncoder(&buf, msgpackHandle)
+		for i := range resps {
+			if err := enc.Encode(&resps[i]); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := enc.Encode("hello"); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		return &buf
+	}
+
+	cases := []struct {
+		name string
+		resp rpc.Response
+	}{
+		{"seq", rpc.Response{ServiceMethod: "Test.Echo", Seq: 3}},
+		{"method", rpc.Response{ServiceMethod: "Test.Other", Seq: 2}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := responses(rpc.Response{ServiceMethod: "Test.Echo", Seq: 1}, tc.resp)
+			cc := NewCodec(false, false, &bufConn{r: buf})
+			caller := &CallerSeq{CheckResponse: true}
+
+			var out string
+			if err := caller.CallWithCodec(cc, "Test.Echo", "hello", &out); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := caller.CallWithCodec(cc, "Test.Echo", "hello", &out); err != ErrResponseMismatch {
+				t.Fatalf("bad: %v", err)
+			}
+			if !cc.IsClosed() {
+				t.Fatalf("expected codec to be closed")
+			}
+		})
+	}
+
+	// Without the check, a mismatched response is accepted.
+	buf := responses(rpc.Response{ServiceMethod: "Test.Other", Seq: 9})
+	var out string
+	if err := new(CallerSeq).CallWithCodec(NewCodec(false, false, &bufConn{r: buf}), "Test.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCallWithCodecSized(t *testing.T) {
+	cc := testServer(t)
+
+	// Work out the expected sizes by encoding the same messages, with the
+	// sequence number the call will use.
+	args := "hello world"
+	seq := atomic.LoadUint64(&nextCallSeq) + 1
+	var buf bufConn
+	enc := NewCodec(false, false, &buf)
+	if err := enc.WriteRequest(&rpc.Request{ServiceMethod: "TestService.Echo", Seq: seq}, args); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectedReq := buf.w.Len()
+	buf.w.Reset()
+	if err := enc.WriteResponse(&rpc.Response{ServiceMethod: "TestService.Echo", Seq: seq}, args); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectedResp := buf.w.Len()
+
+	var out string
+	reqBytes, respBytes, err := CallWithCodecSized(cc, "TestService.Echo", args, &out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != args {
+		t.Fatalf("bad: %q", out)
+	}
+	if reqBytes != expectedReq || respBytes != expectedResp {
+		t.Fatalf("bad: %d %d, expected %d %d", reqBytes, respBytes, expectedReq, expectedResp)
+	}
+}
+
+func TestCallWithCodecTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(NewServerCodec(serverConn))
+	conn := &deadlineConn{Conn: clientConn}
+	cc := NewCodec(true, true, conn)
+	defer cc.Close()
+
+	// The deadline is set for the call and cleared after it, so a later
+	// call made after it would have passed still succeeds.
+	var out string
+	if err := CallWithCodecTimeout(cc, "TestService.Echo", "hello", &out, 20*time.Millisecond); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+	conn.lock.Lock()
+	deadlines := append([]time.Time(nil), conn.readDeadlines...)
+	conn.lock.Unlock()
+	if len(deadlines) != 2 || deadlines[0].IsZero() || !deadlines[1].IsZero() {
+		t.Fatalf("bad: %v", deadlines)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if err := CallWithCodec(cc, "TestService.Echo", "world", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "world" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestCallWithCodecTimeout_SlowServer(t *testing.T) {
+	// The server reads the request but never responds.
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go io.Copy(io.Discard, serverConn)
+	cc := NewCodec(true, true, clientConn)
+
+	var out string
+	err := CallWithCodecTimeout(cc, "TestService.Echo", "hello", &out, 20*time.Millisecond)
+	if !isTimeout(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The response may still arrive, so the codec can't be reused.
+	if !cc.IsClosed() {
+		t.Fatalf("expected codec to be closed")
+	}
+	if err := CallWithCodec(cc, "TestService.Echo", "hello", &out); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCallWithCodecDone(t *testing.T) {
+	cc := testServer(t)
+	done := make(chan struct{})
+	var out string
+	if err := CallWithCodecDone(done, cc, "TestService.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// A call blocked waiting for a response is aborted when done is closed.
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go io.Copy(io.Discard, serverConn)
+	cc = NewCodec(true, true, clientConn)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- CallWithCodecDone(done, cc, "TestService.Echo", "hello", &out)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	select {
+	case err := <-errCh:
+		if err != ErrAborted {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected call to be aborted")
+	}
+	if !cc.IsClosed() {
+		t.Fatalf("expected codec to be closed")
+	}
+
+	if err := CallWithCodecDone(done, cc, "TestService.Echo", "hello", &out); err != ErrAborted {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCallWithCodecDynamic(t *testing.T) {
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf, msgpackHandle)
+	for _, msg := range []struct {
+		resp rpc.Response
+		body interface{}
+	}{
+		{rpc.Response{ServiceMethod: "Test.Shape", Seq: 1}, "circle"},
+		{rpc.Response{ServiceMethod: "Test.Number", Seq: 2}, 42},
+		{rpc.Response{ServiceMethod: "Test.Skip", Seq: 3}, map[string]int{"a": 1}},
+		{rpc.Response{ServiceMethod: "Test.Fail", Seq: 4, Error: "boom"}, nil},
+		{rpc.Response{ServiceMethod: "Test.Shape", Seq: 5}, "square"},
+	} {
+		if err := enc.Encode(&msg.resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := enc.Encode(msg.body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	cc := NewCodec(false, false, &bufConn{r: &buf})
+
+	var picked []string
+	var str string
+	var num int
+	pick := func(resp rpc.Response) interface{} {
+		picked = append(picked, resp.ServiceMethod)
+		switch resp.ServiceMethod {
+		case "Test.Shape":
+			return &str
+		case "Test.Number":
+			return &num
+		}
+		return nil
+	}
+
+	if err := CallWithCodecDynamic(cc, "Test.Shape", nil, pick); err != nil || str != "circle" {
+		t.Fatalf("bad: %v %q", err, str)
+	}
+	if err := CallWithCodecDynamic(cc, "Test.Number", nil, pick); err != nil || num != 42 {
+		t.Fatalf("bad: %v %d", err, num)
+	}
+	if err := CallWithCodecDynamic(cc, "Test.Skip", nil, pick); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := CallWithCodecDynamic(cc, "Test.Fail", nil, pick)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "boom" {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The skipped body and the error leave the stream in sync.
+	if err := CallWithCodecDynamic(cc, "Test.Shape", nil, pick); err != nil || str != "square" {
+		t.Fatalf("bad: %v %q", err, str)
+	}
+	expected := []string{"Test.Shape", "Test.Number", "Test.Skip", "Test.Shape"}
+	if !reflect.DeepEqual(picked, expected) {
+		t.Fatalf("bad: %v", picked)
+	}
+}
+
+func TestClosedCodec_EOF(t *testing.T) {
+	newClosed := func(t *testing.T) *MsgpackCodec {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { serverConn.Close() })
+		cc := NewCodec(true, true, clientConn)
+		cc.Close()
+		return cc
+	}
+
+	var out string
+	cases := map[string]func(cc *MsgpackCodec) error{
+		"CallWithCodec": func(cc *MsgpackCodec) error {
+			return CallWithCodec(cc, "TestService.Echo", "hello", &out)
+		},
+		"CallWithCodecTimeout": func(cc *MsgpackCodec) error {
+			return CallWithCodecTimeout(cc, "TestService.Echo", "hello", &out, time.Second)
+		},
+		"CallWithCodecDone": func(cc *MsgpackCodec) error {
+			return CallWithCodecDone(make(chan struct{}), cc, "TestService.Echo", "hello", &out)
+		},
+		"CallWithCodecDynamic": func(cc *MsgpackCodec) error {
+			return CallWithCodecDynamic(cc, "TestService.Echo", "hello", func(rpc.Response) interface{} { return &out })
+		},
+		"CallWithRequestID": func(cc *MsgpackCodec) error {
+			return CallWithRequestID(cc, "TestService.Echo", "id", "hello", &out)
+		},
+		"CallStreaming": func(cc *MsgpackCodec) error {
+			return CallStreaming(cc, "TestService.Echo", func(send func(interface{}) error) error {
+				return send("hello")
+			}, &out)
+		},
+		"ChainedCaller": func(cc *MsgpackCodec) error {
+			return NewChainedCaller(cc).Call("TestService.Echo", "hello", &out)
+		},
+		"WriteRequestDeadline": func(cc *MsgpackCodec) error {
+			return cc.WriteRequestDeadline(&rpc.Request{ServiceMethod: "TestService.Echo"}, "hello", time.Now().Add(time.Second))
+		},
+		"WriteResponse": func(cc *MsgpackCodec) error {
+			return cc.WriteResponse(&rpc.Response{ServiceMethod: "TestService.Echo"}, "hello")
+		},
+		"WriteResponseWithMetadata": func(cc *MsgpackCodec) error {
+			return cc.WriteResponseWithMetadata(&rpc.Response{ServiceMethod: "TestService.Echo"}, map[string]string{"a": "b"}, "hello")
+		},
+		"NewResponseStream": func(cc *MsgpackCodec) error {
+			_, err := cc.NewResponseStream(&rpc.Response{ServiceMethod: "TestService.Echo"})
+			return err
+		},
+		"Flush": func(cc *MsgpackCodec) error {
+			return cc.Flush()
+		},
+		"ReadResponseBody": func(cc *MsgpackCodec) error {
+			// Out of order for the read state, but the codec being closed
+			// takes precedence.
+			return cc.ReadResponseBody(&out)
+		},
+	}
+	for name, call := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := call(newClosed(t)); !errors.Is(err, io.EOF) {
+				t.Fatalf("bad: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"io"
+	"time"
+)
+
+// NewCoalescingCodec returns a MsgpackCodec that doesn't flush after each
+// request or response. Instead, writes are buffered and sent when maxBytes
+// have accumulated, or by a background flush every maxDelay. This trades
+// latency for throughput on chatty, latency insensitive connections.
+// Closing the codec stops the background flush and sends any remaining
+// data.
+func NewCoalescingCodec(conn io.ReadWriteCloser, maxDelay time.Duration, maxBytes int) *MsgpackCodec {
+	return NewCodecFromConfig(conn, &Config{
+		BufferedReads:   true,
+		BufferedWrites:  true,
+		DeferFlush:      true,
+		WriteBufferSize: maxBytes,
+		FlushInterval:   maxDelay,
+	})
+}
@@ -5,9 +5,17 @@ package msgpackrpc
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/rpc"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/go-msgpack/v2/codec"
 )
@@ -15,18 +23,367 @@ import (
 var (
 	// msgpackHandle is shared handle for decoding
 	msgpackHandle = &codec.MsgpackHandle{}
+
+	// genericHandle is used to decode bodies into generic values that can
+	// be re-encoded as JSON.
+	genericHandle = func() *codec.MsgpackHandle {
+		h := &codec.MsgpackHandle{}
+		h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+		h.RawToString = true
+		return h
+	}()
+
+	// ErrInvalidMethod is returned when a request's method is not of the
+	// form "Service.Method".
+	ErrInvalidMethod = errors.New("msgpackrpc: method must be of the form \"Service.Method\"")
+
+	// ErrProtocolDesync is returned when a header or body is read out of
+	// order, or after a failed read left the stream part way through a
+	// message, since anything read from it would be garbage. Reads from a
+	// closed codec return io.EOF instead, so a dead connection is always
+	// reported the same way.
+	ErrProtocolDesync = errors.New("msgpackrpc: read out of order or after a failed read")
+
+	// ErrMethodTooLong is returned when reading a request header whose
+	// method name is longer than the configured MaxMethodLen.
+	ErrMethodTooLong = errors.New("msgpackrpc: method name too long")
+
+	// ErrBadMagic is returned when reading from a codec configured with a
+	// magic whose peer sent something else at the start of the connection.
+	ErrBadMagic = errors.New("msgpackrpc: connection did not start with the expected magic")
 )
 
+// msgpackNil is the encoding of a msgpack nil.
+const msgpackNil = 0xc0
+
+// PreEncoded is a body that has already been encoded as msgpack, for
+// example a frequently sent request cached in its encoded form. It is written
+// to the connection as-is rather than being encoded again.
+type PreEncoded []byte
+
+// Logger is used by a MsgpackCodec to report errors that would otherwise be
+// lost, such as a failed response write. It is satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Config is used to configure a MsgpackCodec created with
+// NewCodecFromConfig.
+type Config struct {
+	// BufferedReads and BufferedWrites enable buffering of the
+	// underlying connection for reads and writes respectively.
+	BufferedReads  bool
+	BufferedWrites bool
+
+	// Handle is the msgpack handle used for encoding and decoding. If
+	// nil, the shared default handle is used.
+	Handle *codec.MsgpackHandle
+
+	// Logger is used to log errors that cause the codec to be closed. If
+	// nil, these errors are not logged.
+	Logger Logger
+
+	// DeferFlush stops WriteRequest and WriteResponse from flushing the
+	// write buffer, leaving it to the caller to call Flush. This allows
+	// many requests to be sent with a single write to the connection. It
+	// should not be used with net/rpc, which never calls Flush.
+	DeferFlush bool
+
+	// ReuseBuffers keeps the encoder and decoder's internal buffers for
+	// the life of the codec, instead of returning them to a shared pool
+	// after every message. This reduces allocations when a connection
+	// carries a steady stream of messages.
+	//
+	// Decoding into a value that is reused between messages reuses its
+	// slice and map storage where possible. Stale entries can be left
+	// behind unless the handle's SliceElementReset, MapValueReset and
+	// InterfaceReset options are set, so only reuse values when that is
+	// acceptable.
+	//
+	// This only applies when Handle is nil. A configured handle uses its
+	// own ExplicitRelease setting.
+	ReuseBuffers bool
+
+	// RawToString decodes msgpack str and bin values into a string rather
+	// than a []byte when the target is an interface{}. This helps when
+	// peers disagree on whether strings are sent as str or bin. Decoding
+	// into a string field works either way.
+	//
+	// This only applies when Handle is nil. A configured handle uses its
+	// own RawToString setting.
+	RawToString bool
+
+	// Canonical sorts map keys when encoding, so that identical values
+	// always encode to identical bytes. This is needed to sign or content
+	// address messages, at the cost of slower encoding of maps.
+	//
+	// This only applies when Handle is nil. A configured handle uses its
+	// own Canonical setting.
+	Canonical bool
+
+	// StrictFields makes decoding a map into a struct fail if the map has
+	// a key with no matching field, rather than silently ignoring it. This
+	// catches misspelled fields in APIs where that should be an error.
+	//
+	// This only applies when Handle is nil. A configured handle uses its
+	// own ErrorIfNoField setting.
+	StrictFields bool
+
+	// ReadBufferSize is the size of the read buffer when BufferedReads is
+	// set. If zero, the bufio default is used.
+	ReadBufferSize int
+
+	// WriteBufferSize is the size of the write buffer when BufferedWrites
+	// is set. The buffer is flushed whenever it fills. If zero, the bufio
+	// default is used.
+	WriteBufferSize int
+
+	// FlushInterval, if set along with BufferedWrites, starts a goroutine
+	// that flushes the write buffer at this interval until the codec is
+	// closed. It is intended for use with DeferFlush, to coalesce many
+	// writes into fewer, larger ones while bounding their latency. Close
+	// flushes anything still buffered, unless a write is in progress.
+	FlushInterval time.Duration
+
+	// ValidateMethods checks that the method of each request written is of
+	// the form "Service.Method", returning ErrInvalidMethod without
+	// writing anything if not. A malformed method would otherwise only
+	// fail once it reaches the server, with a less helpful error.
+	ValidateMethods bool
+
+	// MaxMethodLen, if set, limits the length of the method name in each
+	// request header read. A longer name fails with ErrMethodTooLong and
+	// closes the connection. The header is read through a limit, so an
+	// oversized name from an untrusted peer is rejected without being read
+	// in full. DefaultMaxMethodLen is a generous limit for most servers.
+	MaxMethodLen int
+
+	// AtomicWrites encodes each request or response in full into a
+	// scratch buffer and sends it with a single write to the connection,
+	// so a header is never written without its body, even if the process
+	// dies part way through. It takes the place of BufferedWrites.
+	AtomicWrites bool
+
+	// ResetEncoderAfter, if set, reinitializes the encoder every this many
+	// requests or responses written, releasing internal buffers it may have
+	// grown to fit the largest message seen, along with the codec's own
+	// scratch buffer for bodies. This bounds the memory held by a codec that
+	// occasionally sends a huge message and then many small ones, at the
+	// cost of regrowing the buffers after each reset. A reset is cheap
+	// compared to a write, so a value in the hundreds or thousands keeps the
+	// cost negligible.
+	ResetEncoderAfter int
+
+	// SlowThreshold, if set along with Logger, logs each request or
+	// response write, and each body read, that takes longer than this,
+	// along with its method and sequence number. This surfaces latency
+	// outliers in the transport, such as TCP retransmits. Header reads
+	// aren't timed, since they include the wait for the peer to send the
+	// next message.
+	SlowThreshold time.Duration
+
+	// Magic, if set, is written to the connection before the first message
+	// sent, and must be the first thing read from it before the first
+	// message received. If the peer sends anything else, reading fails with
+	// ErrBadMagic and the connection is closed. Both ends must use the same
+	// magic. This gives a clear error when something that doesn't speak the
+	// protocol, such as an HTTP client, connects.
+	Magic []byte
+}
+
+// DefaultMaxMethodLen is a suggested value for Config.MaxMethodLen, well
+// beyond the length of any reasonable method name.
+const DefaultMaxMethodLen = 4096
+
+// headerOverhead is the allowance for the rest of a request header when
+// limiting its size to MaxMethodLen.
+const headerOverhead = 64
+
+// maxReusedMessageBuffer is the largest scratch buffer kept between
+// messages by a codec with AtomicWrites, so one large message doesn't pin
+// its memory for the life of the connection.
+const maxReusedMessageBuffer = 64 * 1024
+
+// peekTimeout is how long PeekReadable waits for data to arrive.
+const peekTimeout = time.Millisecond
+
+// DefaultHandle returns a copy of the handle used by codecs that aren't
+// given one, such as those from NewCodec, so its settings can be inspected.
+// The default handle is shared by all of those codecs, so a copy is returned
+// to keep changes from affecting them. It can be modified and passed to
+// NewCodecFromHandle to start from the defaults.
+func DefaultHandle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.TypeInfos = msgpackHandle.TypeInfos
+	h.RPCOptions = msgpackHandle.RPCOptions
+	h.TimeNotBuiltin = msgpackHandle.TimeNotBuiltin
+	h.ExplicitRelease = msgpackHandle.ExplicitRelease
+	h.DecodeOptions = msgpackHandle.DecodeOptions
+	h.EncodeOptions = msgpackHandle.EncodeOptions
+	h.NoFixedNum = msgpackHandle.NoFixedNum
+	h.WriteExt = msgpackHandle.WriteExt
+	h.PositiveIntUnsigned = msgpackHandle.PositiveIntUnsigned
+	return h
+}
+
+// handle returns the handle to use for the configuration. The shared
+// default handle is used unless a handle or any handle options are set.
+func (c *Config) handle() *codec.MsgpackHandle {
+	if c.Handle != nil {
+		return c.Handle
+	}
+	if !c.ReuseBuffers && !c.RawToString && !c.Canonical && !c.StrictFields {
+		return msgpackHandle
+	}
+	h := &codec.MsgpackHandle{}
+	h.ExplicitRelease = c.ReuseBuffers
+	h.RawToString = c.RawToString
+	h.Canonical = c.Canonical
+	h.ErrorIfNoField = c.StrictFields
+	return h
+}
+
+// Encoder encodes values to a stream. It is satisfied by *codec.Encoder.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder decodes values from a stream. It is satisfied by *codec.Decoder.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// flusher is implemented by connections that buffer writes internally, such
+// as those that compress the stream.
+type flusher interface {
+	Flush() error
+}
+
+// ValidateMethod returns ErrInvalidMethod if method is not of the form
+// "Service.Method", as required by net/rpc servers.
+func ValidateMethod(method string) error {
+	dot := strings.LastIndex(method, ".")
+	if dot <= 0 || dot == len(method)-1 {
+		return fmt.Errorf("%w: %q", ErrInvalidMethod, method)
+	}
+	return nil
+}
+
+// validateMethod validates method if the codec is configured to.
+func (cc *MsgpackCodec) validateMethod(method string) error {
+	if !cc.validate {
+		return nil
+	}
+	return ValidateMethod(method)
+}
+
+// readDeadliner is implemented by connections that support read deadlines,
+// such as net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// writeDeadliner is implemented by connections that support write
+// deadlines, such as net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
 // MsgpackCodec implements the rpc.ClientCodec and rpc.ServerCodec
 // using the msgpack encoding
 type MsgpackCodec struct {
-	closed    bool
+	closed    atomic.Bool
 	conn      io.ReadWriteCloser
 	bufR      *bufio.Reader
 	bufW      *bufio.Writer
-	enc       *codec.Encoder
-	dec       *codec.Decoder
+	msgBuf    *messageBuffer
+	w         *countingWriter
+	flusher   flusher
+	enc       Encoder
+	dec       Decoder
+	h         codec.Handle
+	readLock  sync.Mutex
 	writeLock sync.Mutex
+	logger    Logger
+
+	deferFlush  bool
+	validate    bool
+	flushStopCh chan struct{}
+
+	// writes counts calls to write, so that the FlushAfter timer can tell
+	// whether the codec has been idle. These are guarded by the writeLock.
+	writes          uint64
+	idleFlushWrites uint64
+	idleFlushDelay  time.Duration
+	idleFlushTimer  *time.Timer
+
+	// bodyEnc encodes bodies into bodyBuf ahead of their header. It is nil
+	// if bodies are encoded directly. These are guarded by the writeLock.
+	bodyEnc *codec.Encoder
+	bodyBuf []byte
+	bodyRaw PreEncoded
+
+	// resetEncoderAfter is the number of writes between encoder resets,
+	// and encoderResets counts them.
+	resetEncoderAfter uint64
+	encoderResets     uint64
+
+	// slowThreshold is the duration over which operations are logged, and
+	// headerMethod and headerSeq identify the message whose header was last
+	// read, for logging a slow body read.
+	slowThreshold time.Duration
+	headerMethod  string
+	headerSeq     uint64
+
+	// magic is the Config.Magic. magicUnsent is set until it has been
+	// written, guarded by the writeLock, and magicUnread until the peer's
+	// has been read from magicR, guarded by the readLock.
+	magic       []byte
+	magicUnsent bool
+	magicUnread bool
+	magicR      io.Reader
+
+	// inFlight counts requests that have been read but not yet responded
+	// to.
+	inFlight atomic.Int64
+
+	// headerLimit limits the size of request headers when maxMethodLen is
+	// set.
+	headerLimit  *limitReader
+	maxMethodLen int
+
+	// readState is the part of a message expected to be read next. It is
+	// guarded by the readLock.
+	readState readState
+
+	// budgetSet is set when a read deadline from ReadRequestHeaderBudget is
+	// in effect until the request body has been read. It is guarded by the
+	// readLock.
+	budgetSet bool
+
+	// hasRequestID is set when the last request header said that a request
+	// ID follows it, and requestID holds it once read.
+	hasRequestID bool
+	requestID    string
+
+	// hasReqMetadata is set when the last request header said that
+	// metadata follows it, after any request ID, and reqMetadata holds it
+	// once read.
+	hasReqMetadata bool
+	reqMetadata    map[string]string
+
+	// hasMetadata is set when the last response header said that metadata
+	// follows the body, and metadata holds it once read.
+	hasMetadata bool
+	metadata    map[string]string
+
+	// onClose is called when the codec is closed.
+	onClose     func()
+	onCloseLock sync.Mutex
+
+	// isProgress is set when the last response header read was for a
+	// progress frame rather than the final response.
+	isProgress bool
 }
 
 // NewCodec returns a MsgpackCodec that can be used as either a Client or Server
@@ -41,85 +398,1271 @@ func NewCodec(bufReads, bufWrites bool, conn io.ReadWriteCloser) *MsgpackCodec {
 // enabling and disabling buffering for both reads and writes.
 func NewCodecFromHandle(bufReads, bufWrites bool, conn io.ReadWriteCloser,
 	h *codec.MsgpackHandle) *MsgpackCodec {
+	return NewCodecFromConfig(conn, &Config{
+		BufferedReads:  bufReads,
+		BufferedWrites: bufWrites,
+		Handle:         h,
+	})
+}
+
+// NewCodecFromConfig returns a MsgpackCodec that can be used as either a
+// Client or Server rpc Codec using the passed configuration.
+func NewCodecFromConfig(conn io.ReadWriteCloser, conf *Config) *MsgpackCodec {
+	return newCodec(conn, conf, conf.handle())
+}
+
+// NewCodecFromGenericHandle is the same as NewCodecFromHandle, but accepts
+// any go-msgpack handle, such as a codec.JsonHandle, to use an encoding
+// other than msgpack with the same request and response framing. Both ends
+// must use the same encoding. Features that work with raw msgpack bytes,
+// such as codec.Raw and PreEncoded bodies, ReadResponseBodyPresent and
+// ServeConnRecover, need a msgpack handle.
+func NewCodecFromGenericHandle(bufReads, bufWrites bool, conn io.ReadWriteCloser, h codec.Handle) *MsgpackCodec {
+	return newCodec(conn, &Config{
+		BufferedReads:  bufReads,
+		BufferedWrites: bufWrites,
+	}, h)
+}
+
+// NewCodecWithMagic returns a MsgpackCodec with buffered reads and writes
+// that sends magic at the start of the connection and expects the peer to do
+// the same. See Config.Magic.
+func NewCodecWithMagic(conn io.ReadWriteCloser, magic []byte) *MsgpackCodec {
+	return NewCodecFromConfig(conn, &Config{
+		BufferedReads:  true,
+		BufferedWrites: true,
+		Magic:          magic,
+	})
+}
+
+// NewAtomicCodec returns a MsgpackCodec with buffered reads that sends
+// each request or response to conn with a single write, header and body
+// together. See Config.AtomicWrites.
+func NewAtomicCodec(conn io.ReadWriteCloser) *MsgpackCodec {
+	return NewCodecFromConfig(conn, &Config{
+		BufferedReads: true,
+		AtomicWrites:  true,
+	})
+}
+
+// newCodec returns a codec for conn configured by conf, using the handle h
+// in place of any set in conf.
+func newCodec(conn io.ReadWriteCloser, conf *Config, h codec.Handle) *MsgpackCodec {
 	cc := &MsgpackCodec{
-		conn: conn,
+		conn:       conn,
+		h:          h,
+		logger:     conf.Logger,
+		deferFlush: conf.DeferFlush,
+		validate:   conf.ValidateMethods,
 	}
-	if bufReads {
-		cc.bufR = bufio.NewReader(conn)
-		cc.dec = codec.NewDecoder(cc.bufR, h)
-	} else {
-		cc.dec = codec.NewDecoder(cc.conn, h)
+	cc.flusher, _ = conn.(flusher)
+	var r io.Reader = conn
+	if conf.BufferedReads {
+		cc.bufR = bufio.NewReaderSize(conn, conf.ReadBufferSize)
+		r = cc.bufR
 	}
-	if bufWrites {
-		cc.bufW = bufio.NewWriter(conn)
-		cc.enc = codec.NewEncoder(cc.bufW, h)
-	} else {
-		cc.enc = codec.NewEncoder(cc.conn, h)
+	if len(conf.Magic) > 0 {
+		cc.magic = append([]byte(nil), conf.Magic...)
+		cc.magicUnsent, cc.magicUnread = true, true
+		cc.magicR = r
+	}
+	if conf.MaxMethodLen > 0 {
+		cc.maxMethodLen = conf.MaxMethodLen
+		cc.headerLimit = &limitReader{r: r, n: -1}
+		r = cc.headerLimit
+		if cc.bufR != nil {
+			r = limitByteReader{cc.headerLimit, cc.bufR}
+		}
+	}
+	cc.dec = codec.NewDecoder(r, h)
+	var w io.Writer = fullWriter{conn}
+	if conf.AtomicWrites {
+		cc.msgBuf = &messageBuffer{w: w}
+		w = cc.msgBuf
+	} else if conf.BufferedWrites {
+		cc.bufW = bufio.NewWriterSize(w, conf.WriteBufferSize)
+		w = cc.bufW
+	}
+	cc.w = &countingWriter{w: w}
+	cc.enc = codec.NewEncoder(cc.w, h)
+	if conf.Logger != nil {
+		cc.slowThreshold = conf.SlowThreshold
+	}
+	if conf.ResetEncoderAfter > 0 {
+		cc.resetEncoderAfter = uint64(conf.ResetEncoderAfter)
+	}
+	if cc.msgBuf == nil {
+		// A message buffer already drops a partial message, so there is
+		// no need to encode bodies ahead.
+		cc.bodyEnc = codec.NewEncoderBytes(&cc.bodyBuf, h)
+	}
+	if conf.BufferedWrites && conf.FlushInterval > 0 {
+		cc.flushStopCh = make(chan struct{})
+		go cc.flushLoop(conf.FlushInterval)
+	}
+	return cc
+}
+
+// NewCodecWithEncDec returns a MsgpackCodec that uses the given encoder and
+// decoder, which must read from and write to conn without buffering. This
+// is mainly useful in tests, where a fake encoder or decoder can be used to
+// simulate failures at a chosen point.
+func NewCodecWithEncDec(conn io.ReadWriteCloser, enc Encoder, dec Decoder) *MsgpackCodec {
+	cc := &MsgpackCodec{
+		conn: conn,
+		w:    &countingWriter{w: fullWriter{conn}},
+		enc:  enc,
+		dec:  dec,
+		h:    msgpackHandle,
 	}
+	cc.flusher, _ = conn.(flusher)
 	return cc
 }
 
 func (cc *MsgpackCodec) ReadRequestHeader(r *rpc.Request) error {
-	return cc.read(r)
+	if cc.headerLimit != nil {
+		return cc.readRequestHeaderLimited(r)
+	}
+	if err := cc.readRequestHeader(r); err != nil {
+		return err
+	}
+	cc.inFlight.Add(1)
+	return nil
+}
+
+// readRequestHeader reads a request header into r, noting whether a request
+// ID follows it.
+func (cc *MsgpackCodec) readRequestHeader(r *rpc.Request) error {
+	var header requestHeader
+	if err := cc.readAt(readHeader, readBody, &header); err != nil {
+		return err
+	}
+	r.ServiceMethod = header.ServiceMethod
+	r.Seq = header.Seq
+	cc.hasRequestID = header.RequestID
+	cc.requestID = ""
+	cc.hasReqMetadata = header.Metadata
+	cc.reqMetadata = nil
+	cc.headerMethod, cc.headerSeq = header.ServiceMethod, header.Seq
+	return nil
+}
+
+// ReadRequestHeaderBudget reads a request header like ReadRequestHeader, but
+// fails with a timeout error if the header and the body that follows it
+// haven't both been read by deadline. This stops a client that sends a
+// header and then stalls, or trickles a request in slowly, from tying up the
+// server. The deadline is applied as a read deadline on the connection and
+// cleared once the body has been read. If the connection doesn't support read
+// deadlines, no deadline is applied. The timeout error may be wrapped by the
+// decoder, so it should be detected with a check that follows Cause or
+// Unwrap, rather than a type assertion on the error.
+func (cc *MsgpackCodec) ReadRequestHeaderBudget(r *rpc.Request, deadline time.Time) error {
+	if d := cc.connReadDeadliner(); d != nil {
+		if err := d.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+		cc.readLock.Lock()
+		cc.budgetSet = true
+		cc.readLock.Unlock()
+	}
+	return cc.ReadRequestHeader(r)
 }
 
+// readRequestHeaderLimited reads a request header, enforcing MaxMethodLen.
+func (cc *MsgpackCodec) readRequestHeaderLimited(r *rpc.Request) error {
+	cc.headerLimit.n = int64(cc.maxMethodLen + headerOverhead)
+	cc.headerLimit.exceeded = false
+	err := cc.readRequestHeader(r)
+	cc.headerLimit.n = -1
+	if cc.headerLimit.exceeded || (err == nil && len(r.ServiceMethod) > cc.maxMethodLen) {
+		if cc.logger != nil {
+			cc.logger.Printf("[ERR] msgpackrpc: request method name exceeds %d bytes, closing connection", cc.maxMethodLen)
+		}
+		cc.closeConn()
+		return ErrMethodTooLong
+	}
+	if err != nil {
+		return err
+	}
+	cc.inFlight.Add(1)
+	return nil
+}
+
+// ReadRequestBody decodes the request body into out. If out is a
+// *codec.Raw, the undecoded msgpack bytes of the body are captured instead,
+// and they can be forwarded by passing them as the body of another write.
 func (cc *MsgpackCodec) ReadRequestBody(out interface{}) error {
-	return cc.read(out)
+	if cc.slowThreshold > 0 {
+		defer cc.logIfSlow("read request body", cc.headerMethod, cc.headerSeq, time.Now())
+	}
+	return cc.readAt(readBody, readHeader, out)
 }
 
+// WriteResponse writes a response header and body. If the body can't be
+// encoded, an error response is sent in its place, so the client isn't
+// left waiting for a response net/rpc won't resend.
 func (cc *MsgpackCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	return cc.writeResponse(r, r, body)
+}
+
+// TryWriteResponse writes a response like WriteResponse, but returns an
+// error without closing the codec. WriteResponse closes it because net/rpc
+// ignores the error, which would leave a partial response on the wire. A
+// custom serve loop that checks the error can use this instead, but is then
+// responsible for the codec: after a failed write it may hold part of the
+// response, so it must usually be closed rather than written to again.
+func (cc *MsgpackCodec) TryWriteResponse(r *rpc.Response, body interface{}) error {
+	defer cc.inFlight.Add(-1)
 	cc.writeLock.Lock()
 	defer cc.writeLock.Unlock()
+	body, err := cc.encodeBody(body)
+	if err != nil {
+		return err
+	}
 	return cc.write(r, body)
 }
 
+// writeResponse writes header and body, followed by any trailer, as the
+// response to r.
+func (cc *MsgpackCodec) writeResponse(r *rpc.Response, header, body interface{}, trailer ...interface{}) error {
+	defer cc.inFlight.Add(-1)
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	if cc.slowThreshold > 0 {
+		defer cc.logIfSlow("write response", r.ServiceMethod, r.Seq, time.Now())
+	}
+	body, err := cc.encodeBody(body)
+	if err != nil {
+		if cc.logger != nil {
+			cc.logger.Printf("[ERR] msgpackrpc: failed to encode response body for %s (seq %d): %v",
+				r.ServiceMethod, r.Seq, err)
+		}
+		// Nothing has been written yet, so send the error instead.
+		header = &rpc.Response{
+			ServiceMethod: r.ServiceMethod,
+			Seq:           r.Seq,
+			Error:         fmt.Sprintf("msgpackrpc: failed to encode response body: %v", err),
+		}
+		body, trailer = nil, nil
+	}
+	writeErr := cc.write(append([]interface{}{header, body}, trailer...)...)
+	if writeErr != nil {
+		// net/rpc ignores the error returned here, so close the connection
+		// rather than leave a partially written response on the wire.
+		if cc.logger != nil {
+			cc.logger.Printf("[ERR] msgpackrpc: failed to write response for %s (seq %d), closing connection: %v",
+				r.ServiceMethod, r.Seq, writeErr)
+		}
+		cc.closeConn()
+		return writeErr
+	}
+	return err
+}
+
+// ServerResponse is a response header and body to be written by
+// WriteResponseMulti.
+type ServerResponse struct {
+	Header *rpc.Response
+	Body   interface{}
+}
+
+// WriteResponseMulti writes several responses in the order given, flushing
+// only once at the end. This is useful when a burst of pipelined requests
+// completes together. As with WriteResponse, a body that can't be encoded
+// is replaced by an error response and the first such error is returned,
+// and the codec is closed if the write fails.
+func (cc *MsgpackCodec) WriteResponseMulti(resps []ServerResponse) error {
+	defer cc.inFlight.Add(-int64(len(resps)))
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	var encodeErr error
+	objs := make([]interface{}, 0, 2*len(resps))
+	for _, resp := range resps {
+		var header interface{} = resp.Header
+		body, err := cc.encodeBodyCopy(resp.Body)
+		if err != nil {
+			if cc.logger != nil {
+				cc.logger.Printf("[ERR] msgpackrpc: failed to encode response body for %s (seq %d): %v",
+					resp.Header.ServiceMethod, resp.Header.Seq, err)
+			}
+			header = &rpc.Response{
+				ServiceMethod: resp.Header.ServiceMethod,
+				Seq:           resp.Header.Seq,
+				Error:         fmt.Sprintf("msgpackrpc: failed to encode response body: %v", err),
+			}
+			body = nil
+			if encodeErr == nil {
+				encodeErr = err
+			}
+		}
+		objs = append(objs, header, body)
+	}
+	if err := cc.write(objs...); err != nil {
+		if cc.logger != nil {
+			cc.logger.Printf("[ERR] msgpackrpc: failed to write %d responses, closing connection: %v",
+				len(resps), err)
+		}
+		cc.closeConn()
+		return err
+	}
+	return encodeErr
+}
+
 func (cc *MsgpackCodec) ReadResponseHeader(r *rpc.Response) error {
-	return cc.read(r)
+	var header responseHeader
+	if err := cc.readAt(readHeader, readBody, &header); err != nil {
+		return err
+	}
+	r.ServiceMethod = header.ServiceMethod
+	r.Seq = header.Seq
+	r.Error = header.Error
+	cc.hasMetadata = header.Metadata
+	cc.metadata = nil
+	cc.isProgress = header.Progress
+	cc.headerMethod, cc.headerSeq = header.ServiceMethod, header.Seq
+	return nil
 }
 
+// ReadResponseBody decodes the response body into out. As with
+// ReadRequestBody, out may be a *codec.Raw to capture the undecoded body.
 func (cc *MsgpackCodec) ReadResponseBody(out interface{}) error {
-	return cc.read(out)
+	return cc.readResponseBody(out)
 }
 
+// ReadRequestBodyInto decodes the next request body into a new value of
+// type t and returns it. This lets a router decode bodies using a registry
+// of types by method, rather than a type switch. If t is a pointer type, a
+// pointer to a newly allocated value is returned. If t is nil, the body is
+// skipped and nil is returned.
+func (cc *MsgpackCodec) ReadRequestBodyInto(t reflect.Type) (interface{}, error) {
+	if t == nil {
+		return nil, cc.ReadRequestBody(nil)
+	}
+	v := reflect.New(t)
+	if err := cc.ReadRequestBody(v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// ReadRequestBodyGeneric decodes the next request body without knowing its
+// type, so it can be bridged to another encoding such as JSON. Maps are
+// decoded as map[string]interface{} and strings as string, so map keys must
+// be strings. Integers are decoded as int64 or uint64 and keep their full
+// precision, but care is needed when re-encoding them: a JSON consumer that
+// parses numbers as float64 will lose precision above 2^53.
+func (cc *MsgpackCodec) ReadRequestBodyGeneric() (interface{}, error) {
+	var raw codec.Raw
+	if err := cc.readAt(readBody, readHeader, &raw); err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := codec.NewDecoderBytes(raw, genericHandle).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReadResponseBodyPresent decodes the response body into out like
+// ReadResponseBody, but first checks whether the server sent a msgpack nil.
+// If it did, out is left untouched and false is returned. This allows a nil
+// result to be told apart from one that decodes to a zero value.
+func (cc *MsgpackCodec) ReadResponseBodyPresent(out interface{}) (bool, error) {
+	var raw codec.Raw
+	if err := cc.readResponseBody(&raw); err != nil {
+		return false, err
+	}
+	// The decoder leaves a Raw empty rather than capturing a nil.
+	if len(raw) == 0 || (len(raw) == 1 && raw[0] == msgpackNil) {
+		return false, nil
+	}
+	if out == nil {
+		return true, nil
+	}
+	return true, codec.NewDecoderBytes(raw, cc.h).Decode(out)
+}
+
+// ReadResponseBodyMulti decodes a response body that is a msgpack array,
+// such as one written from a []interface{}, assigning each element to the
+// corresponding entry of outs. This allows a method to return a tuple of
+// values without wrapping them in a struct on both sides. An error is
+// returned if the array doesn't have exactly one element for each of outs.
+// A nil entry in outs skips its element.
+func (cc *MsgpackCodec) ReadResponseBodyMulti(outs ...interface{}) error {
+	var raw codec.Raw
+	if err := cc.readResponseBody(&raw); err != nil {
+		return err
+	}
+	var elems []codec.Raw
+	if err := codec.NewDecoderBytes(raw, cc.h).Decode(&elems); err != nil {
+		return err
+	}
+	if len(elems) != len(outs) {
+		return fmt.Errorf("msgpackrpc: response has %d values, expected %d", len(elems), len(outs))
+	}
+	for i, elem := range elems {
+		if outs[i] == nil {
+			continue
+		}
+		if err := codec.NewDecoderBytes(elem, cc.h).Decode(outs[i]); err != nil {
+			return fmt.Errorf("msgpackrpc: failed to decode response value %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// SkipRequestBody reads and discards the next request body, keeping the
+// stream aligned when the body isn't needed.
+func (cc *MsgpackCodec) SkipRequestBody() error {
+	return cc.readAt(readBody, readHeader, nil)
+}
+
+// SkipResponseBody reads and discards the next response body, keeping the
+// stream aligned when the body isn't needed.
+func (cc *MsgpackCodec) SkipResponseBody() error {
+	return cc.readResponseBody(nil)
+}
+
+// DecodeRequestFrom reads a request header and the raw msgpack bytes of its
+// body from r, using the handle h, or the default handle if h is nil. It
+// decodes the same way as a server codec but without a connection, which
+// makes it a convenient entry point for fuzzing.
+func DecodeRequestFrom(r io.Reader, h *codec.MsgpackHandle) (rpc.Request, []byte, error) {
+	if h == nil {
+		h = msgpackHandle
+	}
+	var req rpc.Request
+	var body codec.Raw
+	dec := codec.NewDecoder(r, h)
+	if err := dec.Decode(&req); err != nil {
+		return rpc.Request{}, nil, err
+	}
+	if err := dec.Decode(&body); err != nil {
+		return rpc.Request{}, nil, err
+	}
+	return req, body, nil
+}
+
+// Encode writes a single value outside of the request/response protocol,
+// such as for a handshake, using the codec's encoder. Using the codec rather
+// than a second encoder on the same connection keeps the buffered stream
+// intact. The value is flushed unless DeferFlush is set.
+func (cc *MsgpackCodec) Encode(v interface{}) error {
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	return cc.write(v)
+}
+
+// Decode reads a single value written with Encode on the other end.
+func (cc *MsgpackCodec) Decode(v interface{}) error {
+	return cc.read(v)
+}
+
+// EncodeToBytes encodes v with the codec's handle, without touching the
+// connection. The result matches what the codec would write for v, so it can
+// be cached and sent later as a PreEncoded body.
+func (cc *MsgpackCodec) EncodeToBytes(v interface{}) ([]byte, error) {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, cc.h).Encode(v); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ValidateEncodable checks that v can be encoded with the codec's handle,
+// returning the encoding error if not, without touching the connection.
+// This lets args and response types be checked up front, such as at startup
+// or in tests, rather than failing on the first call. Only the values that
+// v actually holds are checked, so a nil field of an interface type or an
+// empty slice of an unencodable type passes, and v should be populated the
+// way it will be when sent.
+func (cc *MsgpackCodec) ValidateEncodable(v interface{}) error {
+	return validateEncodable(cc.h, v)
+}
+
+// ValidateEncodable is the same as MsgpackCodec.ValidateEncodable, but uses
+// the handle from DefaultHandle, for checking types before any codec has
+// been created.
+func ValidateEncodable(v interface{}) error {
+	return validateEncodable(msgpackHandle, v)
+}
+
+// validateEncodable encodes v with h, discarding the result.
+func validateEncodable(h codec.Handle, v interface{}) error {
+	return codec.NewEncoder(io.Discard, h).Encode(v)
+}
+
+// DecodeFromBytes decodes data into v with the codec's handle, without
+// touching the connection. It is the counterpart of EncodeToBytes, and can
+// also decode a body captured in a codec.Raw.
+func (cc *MsgpackCodec) DecodeFromBytes(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, cc.h).Decode(v)
+}
+
+// Drain reads and discards a single pending response, header and body. This
+// is an advanced tool for realigning the stream when a call was abandoned
+// after its request was written, such as when its context was cancelled, and
+// exactly one response is known to be outstanding. When in doubt, close the
+// codec instead.
+func (cc *MsgpackCodec) Drain() error {
+	var resp rpc.Response
+	if err := cc.ReadResponseHeader(&resp); err != nil {
+		return err
+	}
+	return cc.SkipResponseBody()
+}
+
+// WriteRequest writes a request header and body. The body is encoded before
+// anything is written, so if it can't be encoded an error is returned
+// without writing the header, and the codec can still be used. If writing
+// fails, the codec is closed, and later writes return io.EOF.
 func (cc *MsgpackCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := cc.validateMethod(r.ServiceMethod); err != nil {
+		return err
+	}
 	cc.writeLock.Lock()
 	defer cc.writeLock.Unlock()
-	return cc.write(r, body)
+	if cc.slowThreshold > 0 {
+		defer cc.logIfSlow("write request", r.ServiceMethod, r.Seq, time.Now())
+	}
+	body, err := cc.encodeBody(body)
+	if err != nil {
+		// Nothing has been written, so the codec can still be used.
+		return err
+	}
+	err = cc.write(r, body)
+	if err != nil {
+		// A failed encode or flush may leave part of the request in the
+		// write buffer, which would corrupt the next one, so don't allow
+		// the codec to be reused.
+		cc.closeConn()
+	}
+	return err
 }
 
+// Close closes the codec and its connection. It is safe to call
+// concurrently with reads and writes, and more than once. It doesn't wait for
+// in-flight reads and writes to finish, since closing the connection is what
+// unblocks one stuck on a dead peer. Those fail with an error from the
+// connection, and any started afterwards return io.EOF.
 func (cc *MsgpackCodec) Close() error {
-	if cc.closed {
-		return nil
+	if cc.flushStopCh != nil && !cc.closed.Load() {
+		// Send anything still waiting for the next timed flush, unless a
+		// write is in progress. It may be stuck on a dead peer, and waiting
+		// for it would stop Close from unblocking it.
+		if cc.writeLock.TryLock() {
+			cc.flush()
+			cc.writeLock.Unlock()
+		}
 	}
-	cc.closed = true
-	return cc.conn.Close()
+	onClose, err := cc.shutdown()
+	if onClose != nil {
+		onClose()
+	}
+	return err
 }
 
-func (cc *MsgpackCodec) write(obj1, obj2 interface{}) (err error) {
-	if cc.closed {
-		return io.EOF
+// closeConn marks the codec as closed and closes the connection, without
+// flushing. It is safe to call while holding the writeLock or readLock. The
+// callback from SetOnClose is run on a new goroutine, so it can use the codec
+// without deadlocking on the locks held by the caller.
+func (cc *MsgpackCodec) closeConn() error {
+	onClose, err := cc.shutdown()
+	if onClose != nil {
+		go onClose()
 	}
-	if err = cc.enc.Encode(obj1); err != nil {
+	return err
+}
+
+// shutdown marks the codec as closed and closes the connection, returning
+// the callback from SetOnClose for the caller to run if this call closed it.
+func (cc *MsgpackCodec) shutdown() (func(), error) {
+	if !cc.closed.CompareAndSwap(false, true) {
+		return nil, nil
+	}
+	if cc.flushStopCh != nil {
+		close(cc.flushStopCh)
+	}
+	err := cc.conn.Close()
+
+	cc.onCloseLock.Lock()
+	onClose := cc.onClose
+	cc.onClose = nil
+	cc.onCloseLock.Unlock()
+	return onClose, err
+}
+
+// SetOnClose registers f to be called once the codec is closed, whether by
+// Close or because a failed read or write closed it, such as in
+// WriteResponse. This lets pools and connection managers keep track of live
+// connections without polling IsClosed. f is called exactly once, after the
+// connection has been closed. If Close closed the codec, f is called on its
+// goroutine before it returns. If a failed read or write closed it, f is
+// called on a new goroutine, since the codec's locks are held at that point
+// and a callback that used the codec would otherwise deadlock. If the codec
+// is already closed, f is called right away. Setting a new callback
+// replaces the previous one.
+func (cc *MsgpackCodec) SetOnClose(f func()) {
+	cc.onCloseLock.Lock()
+	if cc.closed.Load() {
+		cc.onCloseLock.Unlock()
+		f()
 		return
 	}
-	if err = cc.enc.Encode(obj2); err != nil {
+	cc.onClose = f
+	cc.onCloseLock.Unlock()
+}
+
+// flushLoop flushes the write buffer every interval until the codec is
+// closed.
+func (cc *MsgpackCodec) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cc.writeLock.Lock()
+			if cc.bufW.Buffered() > 0 {
+				cc.backgroundFlush()
+			}
+			cc.writeLock.Unlock()
+		case <-cc.flushStopCh:
+			return
+		}
+	}
+}
+
+// backgroundFlush flushes the write buffer on behalf of a timer, closing the
+// codec if that fails since there is no caller to return the error to. The
+// writeLock must be held.
+func (cc *MsgpackCodec) backgroundFlush() {
+	if cc.closed.Load() {
+		return
+	}
+	if err := cc.flush(); err != nil {
+		if cc.logger != nil {
+			cc.logger.Printf("[ERR] msgpackrpc: failed to flush, closing connection: %v", err)
+		}
+		cc.closeConn()
+	}
+}
+
+// FlushAfter arms a one-shot timer that flushes the write buffer once no
+// writes have been made for d. Each write made while it is armed pushes the
+// flush back by another d, so a busy connection isn't flushed early, and
+// its buffer is flushed as it fills instead. This bounds the latency of
+// writes left unflushed by DeferFlush, such as the last of a batch, without
+// flushing each one. Calling it again re-arms the timer with the new d.
+func (cc *MsgpackCodec) FlushAfter(d time.Duration) {
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	cc.idleFlushDelay = d
+	cc.idleFlushWrites = cc.writes
+	if cc.idleFlushTimer == nil {
+		cc.idleFlushTimer = time.AfterFunc(d, cc.idleFlush)
+	} else {
+		cc.idleFlushTimer.Reset(d)
+	}
+}
+
+// idleFlush is called by the FlushAfter timer. If there have been writes
+// since it was armed, it waits for another idle period before flushing.
+func (cc *MsgpackCodec) idleFlush() {
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	if cc.writes != cc.idleFlushWrites {
+		cc.idleFlushWrites = cc.writes
+		cc.idleFlushTimer.Reset(cc.idleFlushDelay)
 		return
 	}
+	cc.backgroundFlush()
+}
+
+// WriteRequestN writes a request like WriteRequest, and also returns the
+// number of bytes the encoded request header and body took. The count
+// includes any bytes written before an error. As with WriteRequest, a body
+// that can't be encoded is returned as an error without writing anything,
+// and a failed write closes the codec.
+func (cc *MsgpackCodec) WriteRequestN(r *rpc.Request, body interface{}) (int, error) {
+	if err := cc.validateMethod(r.ServiceMethod); err != nil {
+		return 0, err
+	}
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	body, err := cc.encodeBody(body)
+	if err != nil {
+		return 0, err
+	}
+	start := cc.w.n
+	err = cc.write(r, body)
+	if err != nil {
+		cc.closeConn()
+	}
+	return int(cc.w.n - start), err
+}
+
+// byteCounts returns the total number of bytes read and written by the
+// codec so far. The read count is zero if the decoder doesn't count the
+// bytes it reads.
+func (cc *MsgpackCodec) byteCounts() (read, written int) {
+	cc.readLock.Lock()
+	if counter, ok := cc.dec.(byteCounter); ok {
+		read = counter.NumBytesRead()
+	}
+	cc.readLock.Unlock()
+	cc.writeLock.Lock()
+	written = int(cc.w.n)
+	cc.writeLock.Unlock()
+	return read, written
+}
+
+// WriteRequestDeadline writes a request like WriteRequest, but fails if the
+// write doesn't complete by the deadline d. If the connection doesn't support
+// write deadlines, no deadline is applied. A body that can't be encoded is
+// returned as an error without writing anything. A failed write may leave a
+// partial request on the wire, so the codec is closed, whether or not the
+// connection supports write deadlines.
+func (cc *MsgpackCodec) WriteRequestDeadline(r *rpc.Request, body interface{}, d time.Time) error {
+	if err := cc.validateMethod(r.ServiceMethod); err != nil {
+		return err
+	}
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	if cc.closed.Load() {
+		return io.EOF
+	}
+	body, err := cc.encodeBody(body)
+	if err != nil {
+		// Nothing has been written, so the codec can still be used.
+		return err
+	}
+
+	wd, ok := cc.conn.(writeDeadliner)
+	if !ok {
+		if err := cc.write(r, body); err != nil {
+			cc.closeConn()
+			return err
+		}
+		return nil
+	}
+	if err := wd.SetWriteDeadline(d); err != nil {
+		return err
+	}
+	if err := cc.write(r, body); err != nil {
+		cc.closeConn()
+		return err
+	}
+	return wd.SetWriteDeadline(time.Time{})
+}
+
+// connReadDeadliner returns the connection if it supports read deadlines,
+// or nil otherwise.
+func (cc *MsgpackCodec) connReadDeadliner() readDeadliner {
+	d, _ := cc.conn.(readDeadliner)
+	return d
+}
+
+// Flush writes any buffered data to the connection. It is only needed when
+// the codec was created with DeferFlush set.
+func (cc *MsgpackCodec) Flush() error {
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	if cc.closed.Load() {
+		return io.EOF
+	}
+	return cc.flush()
+}
+
+// InFlight returns the number of requests that have been read by a server
+// codec but not yet responded to. This is the number of RPCs currently being
+// handled for the connection.
+func (cc *MsgpackCodec) InFlight() int64 {
+	return cc.inFlight.Load()
+}
+
+// IsBuffered returns whether reads and writes are buffered. Flush is only
+// meaningful for a codec with buffered writes.
+func (cc *MsgpackCodec) IsBuffered() (reads bool, writes bool) {
+	return cc.bufR != nil, cc.bufW != nil
+}
+
+// RemoteAddr returns the remote address of the connection, or nil if it
+// isn't a net.Conn.
+func (cc *MsgpackCodec) RemoteAddr() net.Addr {
+	if conn, ok := cc.conn.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the connection, or nil if it isn't
+// a net.Conn.
+func (cc *MsgpackCodec) LocalAddr() net.Addr {
+	if conn, ok := cc.conn.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+// IsClosed returns true if the codec has been closed. A closed codec
+// cannot be reused and all further reads and writes return io.EOF.
+func (cc *MsgpackCodec) IsClosed() bool {
+	return cc.closed.Load()
+}
+
+// PeekReadable reports whether data is waiting to be read from the
+// connection, without consuming it. It is intended for checking a pooled
+// connection before reusing it, since unexpected data left from an earlier
+// call means the stream is out of sync. An error means the connection is
+// dead, such as io.EOF if the peer has hung up.
+//
+// This is best-effort. It can only look at the connection for a codec with
+// buffered reads whose connection supports read deadlines, which are used to
+// wait briefly for data. Otherwise it only reports what is already buffered
+// and whether the codec has been closed. A connection that passes may still
+// fail on its next use. It must not be called concurrently with a read.
+//
+// When it waits for data, it clears the connection's read deadline before
+// returning, rather than restoring any deadline set earlier, since a
+// net.Conn doesn't report its current deadline. A caller that relies on a
+// read deadline must set it again afterwards.
+func (cc *MsgpackCodec) PeekReadable() (bool, error) {
+	cc.readLock.Lock()
+	defer cc.readLock.Unlock()
+	if cc.closed.Load() {
+		return false, io.EOF
+	}
+	if cc.bufR == nil {
+		return false, nil
+	}
+	if cc.bufR.Buffered() > 0 {
+		return true, nil
+	}
+	d, ok := cc.conn.(readDeadliner)
+	if !ok {
+		return false, nil
+	}
+
+	if err := d.SetReadDeadline(time.Now().Add(peekTimeout)); err != nil {
+		return false, err
+	}
+	_, err := cc.bufR.Peek(1)
+	if resetErr := d.SetReadDeadline(time.Time{}); err == nil {
+		err = resetErr
+	}
+	if err != nil {
+		if isTimeout(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// encodeBody encodes body into the codec's scratch buffer and returns it as
+// PreEncoded, so that a body that can't be encoded is caught before its
+// header is written. The result is only valid until the next call. Bodies
+// that are already encoded, or codecs that don't leave partial messages on
+// the wire anyway, skip the extra copy. The writeLock must be held.
+func (cc *MsgpackCodec) encodeBody(body interface{}) (interface{}, error) {
+	if cc.bodyEnc == nil || cc.closed.Load() {
+		return body, nil
+	}
+	switch body.(type) {
+	case codec.Raw, *codec.Raw, PreEncoded, *PreEncoded:
+		return body, nil
+	}
+	cc.bodyBuf = cc.bodyBuf[:0]
+	cc.bodyEnc.ResetBytes(&cc.bodyBuf)
+	if err := cc.bodyEnc.Encode(body); err != nil {
+		return nil, err
+	}
+	// Return a pointer to a field, since boxing the slice would allocate.
+	cc.bodyRaw = cc.bodyBuf
+	return &cc.bodyRaw, nil
+}
+
+// encodeBodyCopy is the same as encodeBody, but the result stays valid after
+// the next call, for writing several bodies at once. The writeLock must be
+// held.
+func (cc *MsgpackCodec) encodeBodyCopy(body interface{}) (interface{}, error) {
+	body, err := cc.encodeBody(body)
+	if err == nil && body == &cc.bodyRaw {
+		body = append(PreEncoded(nil), cc.bodyRaw...)
+	}
+	return body, err
+}
+
+// write encodes each of the objects in order, flushing only once at the end
+// unless flushes are deferred.
+func (cc *MsgpackCodec) write(objs ...interface{}) (err error) {
+	if cc.closed.Load() {
+		return io.EOF
+	}
+	cc.writes++
+	if cc.magicUnsent {
+		if _, err = cc.w.Write(cc.magic); err != nil {
+			return
+		}
+		cc.magicUnsent = false
+	}
+	var start int
+	if cc.msgBuf != nil {
+		start = len(cc.msgBuf.buf)
+	}
+	for _, obj := range objs {
+		if err = cc.encode(obj); err != nil {
+			if cc.msgBuf != nil {
+				// Drop the partial message so none of it is sent.
+				cc.msgBuf.buf = cc.msgBuf.buf[:start]
+			}
+			return
+		}
+	}
+	if cc.resetEncoderAfter > 0 && cc.writes%cc.resetEncoderAfter == 0 {
+		cc.resetEncoder()
+	}
+	if cc.deferFlush {
+		return nil
+	}
+	return cc.flush()
+}
+
+// logIfSlow logs op for the message with the given method and sequence
+// number if it has taken longer than the SlowThreshold since start.
+func (cc *MsgpackCodec) logIfSlow(op, method string, seq uint64, start time.Time) {
+	if elapsed := time.Since(start); elapsed > cc.slowThreshold {
+		cc.logger.Printf("[WARN] msgpackrpc: slow %s for %s (seq %d) took %v", op, method, seq, elapsed)
+	}
+}
+
+// resetEncoder reinitializes the encoder against the writer and drops the
+// body scratch buffer, releasing any capacity they have accumulated. The
+// writeLock must be held.
+func (cc *MsgpackCodec) resetEncoder() {
+	if enc, ok := cc.enc.(*codec.Encoder); ok {
+		enc.Reset(cc.w)
+	}
+	if cc.bodyEnc != nil {
+		cc.bodyBuf, cc.bodyRaw = nil, nil
+		cc.bodyEnc.ResetBytes(&cc.bodyBuf)
+	}
+	cc.encoderResets++
+}
+
+// flush writes any buffered data to the connection.
+func (cc *MsgpackCodec) flush() error {
+	if cc.msgBuf != nil {
+		if err := cc.msgBuf.Flush(); err != nil {
+			return err
+		}
+	}
 	if cc.bufW != nil {
-		return cc.bufW.Flush()
+		if err := cc.bufW.Flush(); err != nil {
+			return err
+		}
+	}
+	if cc.flusher != nil {
+		return cc.flusher.Flush()
+	}
+	return nil
+}
+
+// encode encodes a single object. Raw msgpack bytes, such as a body read
+// into a codec.Raw or a PreEncoded body, are written as-is.
+func (cc *MsgpackCodec) encode(obj interface{}) error {
+	var raw []byte
+	switch v := obj.(type) {
+	case codec.Raw:
+		raw = v
+	case *codec.Raw:
+		raw = *v
+	case PreEncoded:
+		raw = v
+	case *PreEncoded:
+		raw = *v
+	default:
+		return cc.enc.Encode(obj)
+	}
+	if len(raw) == 0 {
+		return cc.enc.Encode(nil)
+	}
+	if re, ok := cc.enc.(rawEncoder); ok {
+		return re.EncodeRaw(raw)
+	}
+	_, err := cc.w.Write(raw)
+	return err
+}
+
+// rawEncoder is implemented by encoders that need to wrap already encoded
+// values, rather than have them written directly to the connection.
+type rawEncoder interface {
+	EncodeRaw(raw []byte) error
+}
+
+// countingWriter counts the bytes written through it. It is only written to
+// while holding the codec's writeLock.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// messageBuffer collects everything written to it until Flush, which sends
+// it to w in a single write.
+type messageBuffer struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (m *messageBuffer) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	return len(p), nil
+}
+
+// Flush writes the collected bytes to w. The buffer is reused for the next
+// message, unless it grew unusually large.
+func (m *messageBuffer) Flush() error {
+	if len(m.buf) == 0 {
+		return nil
+	}
+	_, err := m.w.Write(m.buf)
+	if cap(m.buf) > maxReusedMessageBuffer {
+		m.buf = nil
+	} else {
+		m.buf = m.buf[:0]
 	}
-	return
+	return err
 }
 
-func (cc *MsgpackCodec) read(obj interface{}) (err error) {
-	if cc.closed {
+// fullWriter retries short writes until all of p has been written, so a
+// connection that accepts only part of a write doesn't leave a partial
+// message on the wire.
+type fullWriter struct {
+	w io.Writer
+}
+
+func (f fullWriter) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		var nn int
+		nn, err = f.w.Write(p[n:])
+		n += nn
+		if err != nil && err != io.ErrShortWrite {
+			return n, err
+		}
+		if nn == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// writeRequests writes each of the requests and their bodies with a single
+// flush. As with WriteRequest, nothing is written if any of the bodies can't
+// be encoded, and a failed write closes the codec.
+func (cc *MsgpackCodec) writeRequests(reqs []rpc.Request, bodies []interface{}) error {
+	for i := range reqs {
+		if err := cc.validateMethod(reqs[i].ServiceMethod); err != nil {
+			return err
+		}
+	}
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	objs := make([]interface{}, 0, 2*len(reqs))
+	for i := range reqs {
+		body, err := cc.encodeBodyCopy(bodies[i])
+		if err != nil {
+			return err
+		}
+		objs = append(objs, &reqs[i], body)
+	}
+	if err := cc.write(objs...); err != nil {
+		cc.closeConn()
+		return err
+	}
+	return nil
+}
+
+// read decodes the next value into obj, outside of the request/response
+// protocol.
+func (cc *MsgpackCodec) read(obj interface{}) error {
+	cc.readLock.Lock()
+	defer cc.readLock.Unlock()
+	return cc.decode(obj)
+}
+
+// readMagic reads the peer's magic and checks that it matches. If it
+// doesn't, the codec is closed and ErrBadMagic is returned. The readLock
+// must be held.
+func (cc *MsgpackCodec) readMagic() error {
+	buf := make([]byte, len(cc.magic))
+	n, err := io.ReadFull(cc.magicR, buf)
+	if err == io.EOF {
 		return io.EOF
 	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if !bytes.Equal(buf[:n], cc.magic) || n < len(cc.magic) {
+		if cc.logger != nil {
+			cc.logger.Printf("[ERR] msgpackrpc: connection did not start with the expected magic, closing connection")
+		}
+		cc.closeConn()
+		return ErrBadMagic
+	}
+	cc.magicUnread = false
+	return nil
+}
+
+// readState tracks which part of a message is expected to be read next.
+type readState uint8
+
+const (
+	readHeader readState = iota
+	readBody
+	readDesync
+)
+
+// readAt decodes each of objs in order, which must be read when the stream
+// is at state. The stream moves to next once they have all been read, or
+// becomes desynchronized if a read fails part way through a message. Only
+// a clean io.EOF before a header leaves it where it was.
+func (cc *MsgpackCodec) readAt(state, next readState, objs ...interface{}) error {
+	cc.readLock.Lock()
+	defer cc.readLock.Unlock()
+	if cc.closed.Load() {
+		return io.EOF
+	}
+	if cc.readState != state {
+		return ErrProtocolDesync
+	}
+	if state == readBody && (cc.hasRequestID || cc.hasReqMetadata) {
+		// Read the request ID and metadata that come before the body,
+		// whether or not the caller asked for them.
+		var prefix []interface{}
+		if cc.hasRequestID {
+			prefix = append(prefix, &cc.requestID)
+		}
+		if cc.hasReqMetadata {
+			prefix = append(prefix, &cc.reqMetadata)
+		}
+		cc.hasRequestID, cc.hasReqMetadata = false, false
+		objs = append(prefix, objs...)
+	}
+	for _, obj := range objs {
+		if err := cc.decode(obj); err != nil {
+			if err != io.EOF || state != readHeader {
+				cc.readState = readDesync
+			}
+			return err
+		}
+	}
+	if cc.budgetSet && state == readBody && next == readHeader {
+		// The request read under ReadRequestHeaderBudget is complete. Reads
+		// of the request ID, metadata or chunks that come before the end of
+		// the body leave the deadline in place.
+		cc.budgetSet = false
+		if d := cc.connReadDeadliner(); d != nil {
+			if err := d.SetReadDeadline(time.Time{}); err != nil {
+				return err
+			}
+		}
+	}
+	cc.readState = next
+	return nil
+}
+
+// decode decodes the next value into obj. It returns io.EOF only if the
+// connection ended cleanly before the value, and io.ErrUnexpectedEOF if it
+// ended part way through. This relies on the decoder counting the bytes it
+// reads, so a decoder given to NewCodecWithEncDec that doesn't returns
+// io.EOF in both cases. The readLock must be held.
+func (cc *MsgpackCodec) decode(obj interface{}) (err error) {
+	if cc.closed.Load() {
+		return io.EOF
+	}
+	if cc.magicUnread {
+		if err := cc.readMagic(); err != nil {
+			return err
+		}
+	}
+
+	counter, _ := cc.dec.(byteCounter)
+	var start int
+	if counter != nil {
+		start = counter.NumBytesRead()
+	}
 
 	// If nil is passed in, we should still attempt to read content to nowhere.
 	if obj == nil {
 		var obj2 interface{}
-		return cc.dec.Decode(&obj2)
+		obj = &obj2
+	}
+	err = cc.dec.Decode(obj)
+	if err == io.EOF && counter != nil && counter.NumBytesRead() != start {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// limitReader reads from r, failing once n bytes have been read. A
+// negative n means there is no limit. exceeded is set if a read failed
+// because of the limit.
+type limitReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n == 0 {
+		l.exceeded = true
+		return 0, ErrMethodTooLong
+	}
+	if l.n > 0 && int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	if l.n > 0 {
+		l.n -= int64(n)
 	}
-	return cc.dec.Decode(obj)
+	return n, err
+}
+
+// limitByteReader is a limitReader over a buffered reader, which keeps the
+// decoder reading it a byte at a time rather than through Read.
+type limitByteReader struct {
+	*limitReader
+	br io.ByteScanner
+}
+
+func (l limitByteReader) ReadByte() (byte, error) {
+	if l.n == 0 {
+		l.exceeded = true
+		return 0, ErrMethodTooLong
+	}
+	b, err := l.br.ReadByte()
+	if err == nil && l.n > 0 {
+		l.n--
+	}
+	return b, err
+}
+
+func (l limitByteReader) UnreadByte() error {
+	err := l.br.UnreadByte()
+	if err == nil && l.n >= 0 {
+		l.n++
+	}
+	return err
+}
+
+// byteCounter is implemented by decoders that count the bytes they have
+// read, such as *codec.Decoder.
+type byteCounter interface {
+	NumBytesRead() int
 }
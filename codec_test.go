@@ -0,0 +1,1921 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+type testArgs struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestCodec_ForwardRaw(t *testing.T) {
+	args := testArgs{Name: "foo", Count: 42, Tags: []string{"a", "b"}}
+
+	// Write a request from the client.
+	clientConn := &bufConn{}
+	client := NewCodec(true, true, clientConn)
+	req := rpc.Request{ServiceMethod: "Test.Method", Seq: 7}
+	if err := client.WriteRequest(&req, &args); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Read it on a proxy without decoding the body and forward it.
+	proxyConn := &bufConn{r: &clientConn.w}
+	proxy := NewCodec(true, true, proxyConn)
+	var proxyReq rpc.Request
+	if err := proxy.ReadRequestHeader(&proxyReq); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var raw codec.Raw
+	if err := proxy.ReadRequestBody(&raw); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := proxy.WriteRequest(&proxyReq, raw); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Decode the forwarded request on the server.
+	server := NewCodec(true, true, &bufConn{r: &proxyConn.w})
+	var serverReq rpc.Request
+	if err := server.ReadRequestHeader(&serverReq); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(serverReq, req) {
+		t.Fatalf("bad: %#v", serverReq)
+	}
+	var out testArgs
+	if err := server.ReadRequestBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(out, args) {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestCodec_SkipBody(t *testing.T) {
+	conn := &bufConn{}
+	cc := NewCodec(true, true, conn)
+	for i, body := range []interface{}{
+		&testArgs{Name: "foo", Tags: []string{"a"}},
+		"hello",
+	} {
+		req := rpc.Request{ServiceMethod: "Test.Method", Seq: uint64(i)}
+		if err := cc.WriteRequest(&req, body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := rpc.Response{ServiceMethod: "Test.Method", Seq: uint64(i)}
+		if err := cc.WriteResponse(&resp, body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	reader := NewCodec(true, true, &bufConn{r: &conn.w})
+	var req rpc.Request
+	if err := reader.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := reader.SkipRequestBody(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var resp rpc.Response
+	if err := reader.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := reader.SkipResponseBody(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The stream should be aligned on the second request.
+	if err := reader.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Seq != 1 {
+		t.Fatalf("bad: %#v", req)
+	}
+	var out string
+	if err := reader.ReadRequestBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+	if err := reader.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Seq != 1 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if err := reader.ReadResponseBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+// repeatConn is a connection that reads the same data over and over.
+type repeatConn struct {
+	data []byte
+	off  int
+}
+
+func (c *repeatConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data[c.off:])
+	c.off = (c.off + n) % len(c.data)
+	return n, nil
+}
+
+func (c *repeatConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *repeatConn) Close() error                { return nil }
+
+// benchmarkDecode measures reading requests with conf. Each body is decoded
+// into a fresh value, so that only the codec's configuration differs between
+// benchmarks.
+func benchmarkDecode(b *testing.B, conf *Config) {
+	conn := &bufConn{}
+	args := testArgs{Name: "foo", Count: 42, Tags: make([]string, 100)}
+	err := NewCodec(false, false, conn).WriteRequest(&rpc.Request{ServiceMethod: "Test.Method"}, &args)
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	cc := NewCodecFromConfig(&repeatConn{data: conn.w.Bytes()}, conf)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var req rpc.Request
+	for i := 0; i < b.N; i++ {
+		if err := cc.ReadRequestHeader(&req); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+		var out testArgs
+		if err := cc.ReadRequestBody(&out); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkCodec_Decode(b *testing.B) {
+	benchmarkDecode(b, &Config{BufferedReads: true})
+}
+
+func BenchmarkCodec_DecodeReuseBuffers(b *testing.B) {
+	benchmarkDecode(b, &Config{BufferedReads: true, ReuseBuffers: true})
+}
+
+// failingEncoder returns an error from the nth call to Encode.
+type failingEncoder struct {
+	Encoder
+	n int
+}
+
+func (e *failingEncoder) Encode(v interface{}) error {
+	e.n--
+	if e.n == 0 {
+		return errors.New("encode failed")
+	}
+	return e.Encoder.Encode(v)
+}
+
+func TestCodec_WriteResponse_EncodeError(t *testing.T) {
+	conn := &bufConn{}
+	enc := &failingEncoder{Encoder: codec.NewEncoder(conn, msgpackHandle), n: 2}
+	dec := codec.NewDecoder(conn, msgpackHandle)
+	cc := NewCodecWithEncDec(conn, enc, dec)
+
+	resp := rpc.Response{ServiceMethod: "Test.Method", Seq: 1}
+	if err := cc.WriteResponse(&resp, "hello"); err == nil || err.Error() != "encode failed" {
+		t.Fatalf("bad: %v", err)
+	}
+	if !cc.IsClosed() || !conn.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+	if err := cc.WriteResponse(&resp, "hello"); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// recordingLogger is a Logger that keeps every line logged.
+type recordingLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestCodec_WriteResponse_LogsWriteError(t *testing.T) {
+	conn := &failingWriteConn{}
+	logger := &recordingLogger{}
+	cc := New(conn, WithLogger(logger))
+
+	resp := rpc.Response{ServiceMethod: "Test.Method", Seq: 42}
+	if err := cc.WriteResponse(&resp, "hello"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// net/rpc drops the error, so it's logged with the call it was for,
+	// and the connection is closed.
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if len(logger.lines) != 1 {
+		t.Fatalf("bad: %q", logger.lines)
+	}
+	line := logger.lines[0]
+	if !strings.HasPrefix(line, "[ERR] msgpackrpc: failed to write response for Test.Method (seq 42), closing connection:") ||
+		!strings.Contains(line, "write failed") {
+		t.Fatalf("bad: %q", line)
+	}
+	if !cc.IsClosed() || !conn.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+}
+
+func TestCodec_TryWriteResponse(t *testing.T) {
+	conn := &failingWriteConn{}
+	cc := NewCodec(false, false, conn)
+
+	resp := rpc.Response{ServiceMethod: "Test.Method", Seq: 1}
+	// The encoder wraps the connection's error, so check its cause.
+	err := cc.TryWriteResponse(&resp, "hello")
+	cause, ok := err.(interface{ Cause() error })
+	if !ok || cause.Cause().Error() != "write failed" {
+		t.Fatalf("bad: %v", err)
+	}
+	if cc.IsClosed() || conn.closed {
+		t.Fatalf("expected codec to be left open")
+	}
+}
+
+func TestCodec_PreEncoded(t *testing.T) {
+	cc := testServer(t)
+
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, msgpackHandle).Encode("hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	body := PreEncoded(buf.Bytes())
+
+	for i := 0; i < 2; i++ {
+		var resp string
+		if err := CallWithCodec(cc, "TestService.Echo", body, &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp != "hello" {
+			t.Fatalf("bad: %q", resp)
+		}
+	}
+}
+
+func TestCodec_RawToString(t *testing.T) {
+	type body struct {
+		Str   string
+		Iface interface{}
+	}
+
+	// Encode the body with a handle that writes []byte as msgpack bin.
+	var buf bytes.Buffer
+	binHandle := &codec.MsgpackHandle{WriteExt: true}
+	enc := codec.NewEncoder(&buf, binHandle)
+	if err := enc.Encode(&rpc.Request{ServiceMethod: "Test.Method", Seq: 1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := enc.Encode(map[string][]byte{
+		"Str":   []byte("hello"),
+		"Iface": []byte("world"),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, rawToString := range []bool{false, true} {
+		cc := NewCodecFromConfig(&bufConn{r: bytes.NewReader(buf.Bytes())}, &Config{
+			RawToString: rawToString,
+		})
+		var req rpc.Request
+		if err := cc.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out body
+		if err := cc.ReadRequestBody(&out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Str != "hello" {
+			t.Fatalf("bad: %q", out.Str)
+		}
+		if rawToString {
+			if out.Iface != "world" {
+				t.Fatalf("bad: %#v", out.Iface)
+			}
+		} else if !reflect.DeepEqual(out.Iface, []byte("world")) {
+			t.Fatalf("bad: %#v", out.Iface)
+		}
+	}
+}
+
+func TestCodec_ReadRequestBodyGeneric(t *testing.T) {
+	type inner struct {
+		Tags []string
+	}
+	args := struct {
+		Name  string
+		Big   int64
+		Inner inner
+	}{
+		Name:  "foo",
+		Big:   math.MaxInt64 - 1,
+		Inner: inner{Tags: []string{"a", "b"}},
+	}
+
+	conn := &bufConn{}
+	if err := NewCodec(false, false, conn).WriteRequest(&rpc.Request{}, &args); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cc := NewCodec(true, true, &bufConn{r: &conn.w})
+	var req rpc.Request
+	if err := cc.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := cc.ReadRequestBodyGeneric()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := `{"Big":9223372036854775806,"Inner":{"Tags":["a","b"]},"Name":"foo"}`
+	if string(js) != expected {
+		t.Fatalf("bad: %s", js)
+	}
+}
+
+// shortWriteConn accepts at most one byte per write.
+type shortWriteConn struct {
+	bufConn
+}
+
+func (c *shortWriteConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.w.WriteByte(p[0])
+	if len(p) > 1 {
+		return 1, io.ErrShortWrite
+	}
+	return 1, nil
+}
+
+func TestCodec_ShortWrite(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		conn := &shortWriteConn{}
+		cc := NewCodec(buffered, buffered, conn)
+		args := testArgs{Name: "foo", Count: 42, Tags: []string{"a", "b"}}
+		req := rpc.Request{ServiceMethod: "Test.Method", Seq: 1}
+		if err := cc.WriteRequest(&req, &args); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		reader := NewCodec(true, true, &bufConn{r: &conn.w})
+		var out rpc.Request
+		if err := reader.ReadRequestHeader(&out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var outArgs testArgs
+		if err := reader.ReadRequestBody(&outArgs); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(outArgs, args) {
+			t.Fatalf("bad: %#v", outArgs)
+		}
+	}
+}
+
+func TestCodec_Canonical(t *testing.T) {
+	body := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		body[fmt.Sprintf("key-%d", i)] = i
+	}
+
+	encode := func() []byte {
+		conn := &bufConn{}
+		cc := NewCodecFromConfig(conn, &Config{Canonical: true})
+		if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Method"}, body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return conn.w.Bytes()
+	}
+
+	first := encode()
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(encode(), first) {
+			t.Fatalf("encoding is not deterministic")
+		}
+	}
+}
+
+func TestCodec_StrictFields(t *testing.T) {
+	body := map[string]interface{}{"Name": "foo", "Cuont": 42}
+	for _, strict := range []bool{false, true} {
+		conn := &bufConn{}
+		writer := NewCodec(false, false, conn)
+		if err := writer.WriteRequest(&rpc.Request{ServiceMethod: "Test.Method"}, body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		reader := NewCodecFromConfig(&bufConn{r: &conn.w}, &Config{StrictFields: strict})
+		var req rpc.Request
+		if err := reader.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var args testArgs
+		err := reader.ReadRequestBody(&args)
+		if strict && err == nil {
+			t.Fatalf("expected error for unknown field")
+		}
+		if !strict && (err != nil || args.Name != "foo") {
+			t.Fatalf("bad: %v %#v", err, args)
+		}
+	}
+}
+
+func TestCoalescingCodec(t *testing.T) {
+	// Writes are held until the codec is closed.
+	conn := &bufConn{}
+	cc := NewCoalescingCodec(conn, time.Hour, 4096)
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Method"}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conn.w.Len() != 0 {
+		t.Fatalf("expected write to be buffered")
+	}
+	if err := cc.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conn.w.Len() == 0 {
+		t.Fatalf("expected close to flush")
+	}
+
+	// Calls complete once the timed flush runs.
+	client := NewCoalescingCodec(testServer(t).conn, 5*time.Millisecond, 4096)
+	var resp string
+	if err := CallWithCodec(client, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+	client.Close()
+}
+
+func TestCodec_ConcurrentClose(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go io.Copy(io.Discard, serverConn)
+
+	cc := NewCodec(true, true, clientConn)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				req := rpc.Request{ServiceMethod: "Test.Method"}
+				if err := cc.WriteRequest(&req, "hello"); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := cc.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	wg.Wait()
+	if err := cc.WriteRequest(&rpc.Request{}, "hello"); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// failingWriteConn fails every write.
+type failingWriteConn struct {
+	bufConn
+}
+
+func (c *failingWriteConn) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestCodec_WriteRequest_FlushError(t *testing.T) {
+	conn := &failingWriteConn{}
+	cc := NewCodec(true, true, conn)
+
+	req := rpc.Request{ServiceMethod: "Test.Method", Seq: 1}
+	if err := cc.WriteRequest(&req, "hello"); err == nil || err.Error() != "write failed" {
+		t.Fatalf("bad: %v", err)
+	}
+	if !cc.IsClosed() || !conn.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+	req.Seq = 2
+	if err := cc.WriteRequest(&req, "hello"); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCodec_WriteRequestN(t *testing.T) {
+	conn := &bufConn{}
+	cc := NewCodec(true, true, conn)
+
+	req := rpc.Request{ServiceMethod: "Test.Method", Seq: 1}
+	n, err := cc.WriteRequestN(&req, "hello")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != conn.w.Len() {
+		t.Fatalf("bad: %d != %d", n, conn.w.Len())
+	}
+
+	// A body that fails to encode writes nothing and leaves the codec open.
+	req.Seq = 2
+	n, err = cc.WriteRequestN(&req, complex(1, 2))
+	if err == nil || n != 0 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if cc.IsClosed() {
+		t.Fatalf("expected codec to be open")
+	}
+
+	// A failed write closes it.
+	failing := &failingWriteConn{}
+	cc = NewCodec(true, true, failing)
+	if _, err := cc.WriteRequestN(&req, "hello"); err == nil || err.Error() != "write failed" {
+		t.Fatalf("bad: %v", err)
+	}
+	if !cc.IsClosed() || !failing.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+}
+
+func TestCodec_WriteRequestDeadline(t *testing.T) {
+	// The deadline passes with nothing reading the other end of the pipe.
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	cc := NewCodec(true, true, clientConn)
+	req := rpc.Request{ServiceMethod: "Test.Method", Seq: 1}
+	err := cc.WriteRequestDeadline(&req, "hello", time.Now().Add(10*time.Millisecond))
+	if !isTimeout(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	if !cc.IsClosed() {
+		t.Fatalf("expected codec to be closed")
+	}
+
+	// Without deadline support, a failed write still closes the codec.
+	failing := &failingWriteConn{}
+	cc = NewCodec(true, true, failing)
+	err = cc.WriteRequestDeadline(&req, "hello", time.Now().Add(time.Second))
+	if err == nil || err.Error() != "write failed" {
+		t.Fatalf("bad: %v", err)
+	}
+	if !cc.IsClosed() || !failing.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+
+	// A body that fails to encode writes nothing and leaves the codec open.
+	conn := &bufConn{}
+	cc = NewCodec(true, true, conn)
+	if err := cc.WriteRequestDeadline(&req, complex(1, 2), time.Now().Add(time.Second)); err == nil {
+		t.Fatalf("expected error")
+	}
+	if conn.w.Len() != 0 || cc.IsClosed() {
+		t.Fatalf("expected nothing written")
+	}
+	if err := cc.WriteRequestDeadline(&req, "hello", time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCodec_InFlight(t *testing.T) {
+	const n = 4
+	conn := &bufConn{}
+	client := NewCodec(true, true, conn)
+	for i := 1; i <= n; i++ {
+		req := rpc.Request{ServiceMethod: "Test.Method", Seq: uint64(i)}
+		if err := client.WriteRequest(&req, "hello"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	server := NewCodec(true, true, &bufConn{r: &conn.w})
+	if c := server.InFlight(); c != 0 {
+		t.Fatalf("bad: %d", c)
+	}
+	reqs := make([]rpc.Request, n)
+	for i := range reqs {
+		if err := server.ReadRequestHeader(&reqs[i]); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := server.ReadRequestBody(nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if c := server.InFlight(); c != int64(i+1) {
+			t.Fatalf("bad: %d after reading %d", c, i+1)
+		}
+	}
+
+	// The last request gets a streamed response, which stays in flight
+	// until the stream is closed.
+	for i, req := range reqs[:n-1] {
+		resp := rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}
+		if err := server.WriteResponse(&resp, "hello"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if c := server.InFlight(); c != int64(n-i-1) {
+			t.Fatalf("bad: %d after responding to %d", c, i+1)
+		}
+	}
+	s, err := server.NewResponseStream(&rpc.Response{ServiceMethod: reqs[n-1].ServiceMethod, Seq: reqs[n-1].Seq})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.Send("hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if c := server.InFlight(); c != 1 {
+		t.Fatalf("bad: %d", c)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if c := server.InFlight(); c != 0 {
+		t.Fatalf("bad: %d", c)
+	}
+}
+
+func TestCodec_WriteResponseMulti(t *testing.T) {
+	conn := &bufConn{}
+	server := NewCodec(true, true, conn)
+	resps := []ServerResponse{
+		{Header: &rpc.Response{ServiceMethod: "Test.Echo", Seq: 1}, Body: "a"},
+		{Header: &rpc.Response{ServiceMethod: "Test.Echo", Seq: 2}, Body: complex(1, 2)},
+		{Header: &rpc.Response{ServiceMethod: "Test.Echo", Seq: 3}, Body: "c"},
+	}
+	if err := server.WriteResponseMulti(resps); err == nil {
+		t.Fatalf("expected error")
+	}
+	if server.IsClosed() {
+		t.Fatalf("expected codec to be open")
+	}
+
+	// The body that failed to encode is replaced by an error response, and
+	// the others are sent intact.
+	client := NewCodec(true, true, &bufConn{r: &conn.w})
+	for i, expected := range []string{"a", "", "c"} {
+		var header rpc.Response
+		if err := client.ReadResponseHeader(&header); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if header.Seq != uint64(i+1) {
+			t.Fatalf("bad: %#v", header)
+		}
+		var body string
+		if err := client.ReadResponseBody(&body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if expected == "" {
+			if !strings.Contains(header.Error, "failed to encode response body") {
+				t.Fatalf("bad: %#v", header)
+			}
+			continue
+		}
+		if header.Error != "" || body != expected {
+			t.Fatalf("bad: %#v %q", header, body)
+		}
+	}
+
+	// A failed write closes the codec.
+	failing := &failingWriteConn{}
+	server = NewCodec(true, true, failing)
+	if err := server.WriteResponseMulti(resps[:1]); err == nil || err.Error() != "write failed" {
+		t.Fatalf("bad: %v", err)
+	}
+	if !server.IsClosed() || !failing.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+}
+
+func TestCodec_Drain(t *testing.T) {
+	cc := testServer(t)
+
+	// Abandon a call after writing its request, then drain its response so
+	// the next call reads its own.
+	req := rpc.Request{ServiceMethod: "TestService.Echo", Seq: 1}
+	if err := cc.WriteRequest(&req, "abandoned"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cc.Drain(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var resp string
+	if err := CallWithCodec(cc, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+
+	// An error response is drained too.
+	req = rpc.Request{ServiceMethod: "TestService.Fail", Seq: 2}
+	if err := cc.WriteRequest(&req, "boom"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cc.Drain(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := CallWithCodec(cc, "TestService.Echo", "again", &resp); err != nil || resp != "again" {
+		t.Fatalf("bad: %v %q", err, resp)
+	}
+
+	// Draining a closed codec fails.
+	cc.Close()
+	if err := cc.Drain(); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCodec_ReadResponseBodyPresent(t *testing.T) {
+	conn := &bufConn{}
+	server := NewCodec(true, true, conn)
+	for i, body := range []interface{}{nil, testArgs{Name: "foo", Count: 42}, 0, (*testArgs)(nil)} {
+		if err := server.WriteResponse(&rpc.Response{ServiceMethod: "Test.Method", Seq: uint64(i)}, body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	client := NewCodec(true, true, &bufConn{r: &conn.w})
+	read := func(out interface{}) (bool, error) {
+		var header rpc.Response
+		if err := client.ReadResponseHeader(&header); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return client.ReadResponseBodyPresent(out)
+	}
+
+	// A nil body leaves out untouched.
+	out := testArgs{Name: "untouched"}
+	present, err := read(&out)
+	if err != nil || present || out.Name != "untouched" {
+		t.Fatalf("bad: %v %v %#v", present, err, out)
+	}
+
+	// A present body is decoded.
+	out = testArgs{}
+	present, err = read(&out)
+	if err != nil || !present || out.Name != "foo" || out.Count != 42 {
+		t.Fatalf("bad: %v %v %#v", present, err, out)
+	}
+
+	// A zero value is present, even though it decodes like nil would.
+	var n int
+	present, err = read(&n)
+	if err != nil || !present || n != 0 {
+		t.Fatalf("bad: %v %v %d", present, err, n)
+	}
+
+	// A nil pointer is sent as nil, and out may be nil.
+	present, err = read(nil)
+	if err != nil || present {
+		t.Fatalf("bad: %v %v", present, err)
+	}
+}
+
+func TestValidateMethod(t *testing.T) {
+	for _, method := range []string{"Test.Method", "a.b", "Test.Sub.Method"} {
+		if err := ValidateMethod(method); err != nil {
+			t.Fatalf("err: %q %v", method, err)
+		}
+	}
+	for _, method := range []string{"", "Test", ".Method", "Test.", "."} {
+		if err := ValidateMethod(method); !errors.Is(err, ErrInvalidMethod) {
+			t.Fatalf("bad: %q %v", method, err)
+		}
+	}
+}
+
+func TestCodec_ValidateMethods(t *testing.T) {
+	conn := &bufConn{}
+	cc := NewCodecFromConfig(conn, &Config{ValidateMethods: true})
+
+	// A rejected method isn't written, and the codec stays usable.
+	err := cc.WriteRequest(&rpc.Request{ServiceMethod: "NoDot", Seq: 1}, "hello")
+	if !errors.Is(err, ErrInvalidMethod) {
+		t.Fatalf("bad: %v", err)
+	}
+	if conn.w.Len() != 0 || cc.IsClosed() {
+		t.Fatalf("expected nothing written")
+	}
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Method", Seq: 2}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without validation, any method is written.
+	conn = &bufConn{}
+	cc = NewCodecFromConfig(conn, &Config{})
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "NoDot", Seq: 1}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func FuzzDecodeRequestFrom(f *testing.F) {
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf, msgpackHandle)
+	enc.Encode(&rpc.Request{ServiceMethod: "Test.Method", Seq: 1})
+	enc.Encode(testArgs{Name: "foo", Count: 42, Tags: []string{"a", "b"}})
+	f.Add(buf.Bytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, body, err := DecodeRequestFrom(bytes.NewReader(data), nil)
+		if err != nil {
+			return
+		}
+		var args testArgs
+		codec.NewDecoderBytes(body, msgpackHandle).Decode(&args)
+	})
+}
+
+func TestCodec_Addr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	cc := NewCodec(true, true, conn)
+	if cc.RemoteAddr().String() != l.Addr().String() {
+		t.Fatalf("bad: %v", cc.RemoteAddr())
+	}
+	if cc.LocalAddr().String() != conn.LocalAddr().String() {
+		t.Fatalf("bad: %v", cc.LocalAddr())
+	}
+
+	cc = NewCodec(true, true, &bufConn{})
+	if cc.RemoteAddr() != nil || cc.LocalAddr() != nil {
+		t.Fatalf("expected nil addresses")
+	}
+}
+
+func TestDefaultHandle(t *testing.T) {
+	h := DefaultHandle()
+	if h == msgpackHandle {
+		t.Fatalf("expected a copy of the default handle")
+	}
+	if h.WriteExt != msgpackHandle.WriteExt || h.RawToString != msgpackHandle.RawToString {
+		t.Fatalf("bad: %#v", h)
+	}
+	h.WriteExt = !h.WriteExt
+	h.RawToString = !h.RawToString
+	if h.WriteExt == msgpackHandle.WriteExt || h.RawToString == msgpackHandle.RawToString {
+		t.Fatalf("expected the default handle to be unchanged")
+	}
+}
+
+func TestCodec_ReadEOF(t *testing.T) {
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf, msgpackHandle)
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := enc.Encode(&rpc.Response{ServiceMethod: "Test.Echo", Seq: seq}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := enc.Encode("hello"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	full := buf.Bytes()
+
+	for _, buffered := range []bool{false, true} {
+		// A connection closed between messages is a clean EOF.
+		cc := NewCodec(buffered, buffered, &bufConn{r: bytes.NewReader(full)})
+		var out string
+		for i := 0; i < 2; i++ {
+			if err := CallWithCodec(cc, "Test.Echo", "hello", &out); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		var resp rpc.Response
+		if err := cc.ReadResponseHeader(&resp); err != io.EOF {
+			t.Fatalf("bad: %v", err)
+		}
+
+		// One closed part way through a message is not.
+		cc = NewCodec(buffered, buffered, &bufConn{r: bytes.NewReader(full[:len(full)-3])})
+		if err := CallWithCodec(cc, "Test.Echo", "hello", &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := CallWithCodec(cc, "Test.Echo", "hello", &out); err != io.ErrUnexpectedEOF {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+}
+
+func TestCodec_ReadResponseBodyMulti(t *testing.T) {
+	conn := &bufConn{}
+	server := NewCodec(false, false, conn)
+	for seq := uint64(1); seq <= 3; seq++ {
+		resp := rpc.Response{ServiceMethod: "Test.Tuple", Seq: seq}
+		if err := server.WriteResponse(&resp, []interface{}{"foo", 42, testArgs{Name: "bar"}}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	client := NewCodec(false, false, &bufConn{r: &conn.w})
+	var resp rpc.Response
+	if err := client.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var name string
+	var count int
+	var args testArgs
+	if err := client.ReadResponseBodyMulti(&name, &count, &args); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if name != "foo" || count != 42 || args.Name != "bar" {
+		t.Fatalf("bad: %q %d %#v", name, count, args)
+	}
+
+	// Too few and too many outputs are both errors.
+	if err := client.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := client.ReadResponseBodyMulti(&name, &count)
+	if err == nil || err.Error() != "msgpackrpc: response has 3 values, expected 2" {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := client.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var extra string
+	err = client.ReadResponseBodyMulti(&name, &count, &args, &extra)
+	if err == nil || err.Error() != "msgpackrpc: response has 3 values, expected 4" {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCodec_ProtocolDesync(t *testing.T) {
+	conn := &bufConn{}
+	server := NewCodec(false, false, conn)
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := server.WriteResponse(&rpc.Response{ServiceMethod: "Test.Echo", Seq: seq}, "hello"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	client := NewCodec(false, false, &bufConn{r: &conn.w})
+	var out string
+	if err := client.ReadResponseBody(&out); err != ErrProtocolDesync {
+		t.Fatalf("bad: %v", err)
+	}
+	var resp rpc.Response
+	if err := client.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.ReadResponseHeader(&resp); err != ErrProtocolDesync {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Decoding the body into the wrong type leaves the stream part way
+	// through it.
+	var count int
+	if err := client.ReadResponseBody(&count); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := client.ReadResponseHeader(&resp); err != ErrProtocolDesync {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCodec_MaxMethodLen(t *testing.T) {
+	encode := func(methods ...string) *bytes.Buffer {
+		conn := &bufConn{}
+		client := NewCodec(false, false, conn)
+		for _, method := range methods {
+			if err := client.WriteRequest(&rpc.Request{ServiceMethod: method, Seq: 1}, "hello"); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		return &conn.w
+	}
+
+	for _, buffered := range []bool{false, true} {
+		// A name within the limit is read as normal, while one that is
+		// too long but fits within the allowance for the rest of the
+		// header is rejected once read.
+		conn := &bufConn{r: encode("Test.Method", strings.Repeat("a", 100))}
+		server := NewCodecFromConfig(conn, &Config{
+			BufferedReads: buffered,
+			MaxMethodLen:  50,
+		})
+		var req rpc.Request
+		if err := server.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var body string
+		if err := server.ReadRequestBody(&body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if req.ServiceMethod != "Test.Method" || body != "hello" {
+			t.Fatalf("bad: %#v %q", req, body)
+		}
+		if err := server.ReadRequestHeader(&req); err != ErrMethodTooLong {
+			t.Fatalf("bad: %v", err)
+		}
+		if !server.IsClosed() || !conn.closed {
+			t.Fatalf("expected codec to be closed")
+		}
+
+		// One that is far too long is rejected without being read in full.
+		r := encode(strings.Repeat("a", 100000))
+		conn = &bufConn{r: r}
+		server = NewCodecFromConfig(conn, &Config{
+			BufferedReads: buffered,
+			MaxMethodLen:  50,
+		})
+		if err := server.ReadRequestHeader(&req); err != ErrMethodTooLong {
+			t.Fatalf("bad: %v", err)
+		}
+		if !conn.closed {
+			t.Fatalf("expected conn to be closed")
+		}
+		if r.Len() < 90000 {
+			t.Fatalf("expected most of the header to be unread, %d bytes left", r.Len())
+		}
+	}
+}
+
+// benchmarkRequest measures round trips to an rpc.Server over the
+// connections returned by connect, with the given buffering on both ends.
+func benchmarkRequest(b *testing.B, connect func(b *testing.B) (client, server net.Conn), bufReads, bufWrites bool) {
+	benchmarkRequestCodec(b, connect, func(conn net.Conn) *MsgpackCodec {
+		return NewCodec(bufReads, bufWrites, conn)
+	})
+}
+
+func benchmarkRequestCodec(b *testing.B, connect func(b *testing.B) (client, server net.Conn), newCodec func(conn net.Conn) *MsgpackCodec) {
+	clientConn, serverConn := connect(b)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(newCodec(serverConn))
+	cc := newCodec(clientConn)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	var out string
+	for i := 0; i < b.N; i++ {
+		if err := CallWithCodec(cc, "TestService.Echo", "hello", &out); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "req/s")
+}
+
+func pipeConns(b *testing.B) (net.Conn, net.Conn) {
+	return net.Pipe()
+}
+
+func tcpConns(b *testing.B) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		client.Close()
+		b.Fatalf("failed to accept connection")
+	}
+	return client, server
+}
+
+func BenchmarkCodec_Request(b *testing.B) {
+	transports := []struct {
+		name    string
+		connect func(b *testing.B) (net.Conn, net.Conn)
+	}{
+		{"Pipe", pipeConns},
+		{"TCP", tcpConns},
+	}
+	for _, tr := range transports {
+		for _, bufReads := range []bool{false, true} {
+			for _, bufWrites := range []bool{false, true} {
+				name := fmt.Sprintf("%s/BufReads=%v/BufWrites=%v", tr.name, bufReads, bufWrites)
+				b.Run(name, func(b *testing.B) {
+					benchmarkRequest(b, tr.connect, bufReads, bufWrites)
+				})
+			}
+		}
+	}
+}
+
+func BenchmarkCodec_RequestAtomic(b *testing.B) {
+	transports := []struct {
+		name    string
+		connect func(b *testing.B) (net.Conn, net.Conn)
+	}{
+		{"Pipe", pipeConns},
+		{"TCP", tcpConns},
+	}
+	for _, tr := range transports {
+		b.Run(tr.name, func(b *testing.B) {
+			benchmarkRequestCodec(b, tr.connect, func(conn net.Conn) *MsgpackCodec {
+				return NewAtomicCodec(conn)
+			})
+		})
+	}
+}
+
+func TestCodec_Duration(t *testing.T) {
+	type durationArgs struct {
+		Timeout time.Duration
+		Backoff []time.Duration
+	}
+	args := durationArgs{
+		Timeout: 90 * time.Second,
+		Backoff: []time.Duration{0, -time.Millisecond, time.Duration(math.MaxInt64)},
+	}
+
+	conn := &bufConn{}
+	if err := NewCodec(true, true, conn).WriteRequest(&rpc.Request{ServiceMethod: "Test.Method"}, &args); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	server := NewCodec(true, true, &bufConn{r: &conn.w})
+	var req rpc.Request
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out durationArgs
+	if err := server.ReadRequestBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(out, args) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// A peer that writes positive integers as unsigned is also understood.
+	var buf []byte
+	unsigned := &codec.MsgpackHandle{PositiveIntUnsigned: true}
+	if err := codec.NewEncoderBytes(&buf, unsigned).Encode(int64(5 * time.Second)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var d time.Duration
+	if err := codec.NewDecoderBytes(buf, msgpackHandle).Decode(&d); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != 5*time.Second {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestCodec_FlushAfter(t *testing.T) {
+	conn := &bufConn{}
+	cc := NewCodecFromConfig(conn, &Config{BufferedWrites: true, DeferFlush: true})
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Method"}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cc.FlushAfter(10 * time.Millisecond)
+
+	written := func() int {
+		cc.writeLock.Lock()
+		defer cc.writeLock.Unlock()
+		return conn.w.Len()
+	}
+	if written() != 0 {
+		t.Fatalf("expected write to be buffered")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected idle flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCodec_Close_FlushInterval(t *testing.T) {
+	conf := &Config{BufferedWrites: true, DeferFlush: true, FlushInterval: time.Hour}
+
+	// Close sends what's still buffered.
+	conn := &bufConn{}
+	cc := NewCodecFromConfig(conn, conf)
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Method"}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cc.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conn.w.Len() == 0 || !conn.closed {
+		t.Fatalf("expected flush before close")
+	}
+
+	// But it doesn't wait for a write in progress, which may be stuck.
+	conn = &bufConn{}
+	cc = NewCodecFromConfig(conn, conf)
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Method"}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	errCh := make(chan error, 1)
+	go func() { errCh <- cc.Close() }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected close not to wait for the write lock")
+	}
+	if conn.w.Len() != 0 || !conn.closed {
+		t.Fatalf("expected close without flush")
+	}
+}
+
+func TestCodec_GenericHandle(t *testing.T) {
+	h := &codec.JsonHandle{}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(NewCodecFromGenericHandle(true, true, serverConn, h))
+
+	client := rpc.NewClientWithCodec(NewCodecFromGenericHandle(true, true, clientConn, h))
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		var resp string
+		if err := client.Call("TestService.Echo", "hello", &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp != "hello" {
+			t.Fatalf("bad: %q", resp)
+		}
+	}
+}
+
+func TestCodec_PeekReadable(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	cc := NewCodec(true, true, clientConn)
+	defer cc.Close()
+
+	// An idle connection has nothing waiting.
+	ok, err := cc.PeekReadable()
+	if err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// Waiting for data clears the read deadline, even one set earlier.
+	conn := &deadlineConn{Conn: clientConn}
+	withDeadline := NewCodec(true, true, conn)
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	if ok, err := withDeadline.PeekReadable(); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	conn.lock.Lock()
+	if n := len(conn.readDeadlines); n != 3 || !conn.readDeadlines[n-1].IsZero() {
+		t.Fatalf("bad: %v", conn.readDeadlines)
+	}
+	conn.lock.Unlock()
+
+	// Unexpected data is reported without being consumed.
+	go NewCodec(false, false, serverConn).WriteResponse(&rpc.Response{ServiceMethod: "Test.Echo", Seq: 1}, "stale")
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok && err == nil && time.Now().Before(deadline) {
+		ok, err = cc.PeekReadable()
+	}
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	var resp rpc.Response
+	if err := cc.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out string
+	if err := cc.ReadResponseBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Seq != 1 || out != "stale" {
+		t.Fatalf("bad: %v %q", resp, out)
+	}
+
+	// A peer that hung up makes the connection dead.
+	serverConn.Close()
+	if ok, err := cc.PeekReadable(); err == nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// Without buffered reads, only a closed codec is detected.
+	unbuffered := NewCodec(false, true, &bufConn{r: bytes.NewBufferString("data")})
+	if ok, err := unbuffered.PeekReadable(); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	unbuffered.Close()
+	if _, err := unbuffered.PeekReadable(); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// writeRecordingConn records each write made to it.
+type writeRecordingConn struct {
+	bufConn
+	writes [][]byte
+}
+
+func (c *writeRecordingConn) Write(p []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	return c.bufConn.Write(p)
+}
+
+func TestCodec_Atomic(t *testing.T) {
+	conn := &writeRecordingConn{}
+	cc := NewAtomicCodec(conn)
+	args := strings.Repeat("x", 100)
+	for i := 1; i <= 2; i++ {
+		if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: uint64(i)}, args); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(conn.writes) != i {
+			t.Fatalf("bad: %d writes", len(conn.writes))
+		}
+	}
+
+	// Each write holds a whole request.
+	for i, p := range conn.writes {
+		server := NewCodec(false, false, &bufConn{r: bytes.NewBuffer(p)})
+		var req rpc.Request
+		if err := server.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out string
+		if err := server.ReadRequestBody(&out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if req.Seq != uint64(i+1) || out != args {
+			t.Fatalf("bad: %v %q", req, out)
+		}
+		if err := server.Decode(new(interface{})); err != io.EOF {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+
+	// A body that fails to encode sends nothing, not even the header.
+	cc = NewAtomicCodec(conn)
+	conn.writes = nil
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 3}, complex(1, 2)); err == nil {
+		t.Fatalf("expected error")
+	}
+	if len(conn.writes) != 0 {
+		t.Fatalf("bad: %d writes", len(conn.writes))
+	}
+}
+
+func TestCodec_UnencodableBody(t *testing.T) {
+	conn := &bufConn{}
+	cc := NewCodec(true, true, conn)
+
+	// The request isn't written at all, and the codec stays usable.
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 1}, complex(1, 2)); err == nil {
+		t.Fatalf("expected error")
+	}
+	if conn.w.Len() != 0 {
+		t.Fatalf("bad: %d bytes written", conn.w.Len())
+	}
+	if cc.IsClosed() {
+		t.Fatalf("expected codec to be open")
+	}
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 2}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The response is replaced by an error response.
+	if err := cc.WriteResponse(&rpc.Response{ServiceMethod: "Test.Echo", Seq: 3}, complex(1, 2)); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := cc.WriteResponse(&rpc.Response{ServiceMethod: "Test.Echo", Seq: 4}, "world"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The stream stays aligned.
+	peer := NewCodec(true, true, &bufConn{r: &conn.w})
+	var req rpc.Request
+	if err := peer.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out string
+	if err := peer.ReadRequestBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Seq != 2 || out != "hello" {
+		t.Fatalf("bad: %v %q", req, out)
+	}
+	var resp rpc.Response
+	if err := peer.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Seq != 3 || !strings.Contains(resp.Error, "failed to encode response body") {
+		t.Fatalf("bad: %v", resp)
+	}
+	if err := peer.ReadResponseBody(nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := peer.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := peer.ReadResponseBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Seq != 4 || resp.Error != "" || out != "world" {
+		t.Fatalf("bad: %v %q", resp, out)
+	}
+}
+
+func TestCodec_ResetEncoderAfter(t *testing.T) {
+	conn := &bufConn{}
+	cc := New(conn, WithResetEncoderAfter(3))
+
+	huge := strings.Repeat("x", 1<<20)
+	bodies := []string{huge, "a", "b", "c", huge, "d", "e"}
+	for i, body := range bodies {
+		if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: uint64(i)}, body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		switch i {
+		case 2:
+			// The scratch buffer grown by the huge body is released.
+			if cc.encoderResets != 1 || cap(cc.bodyBuf) != 0 {
+				t.Fatalf("bad: %d resets, %d capacity", cc.encoderResets, cap(cc.bodyBuf))
+			}
+		case 4:
+			if cap(cc.bodyBuf) < len(huge) {
+				t.Fatalf("bad: %d capacity", cap(cc.bodyBuf))
+			}
+		}
+	}
+	if cc.encoderResets != 2 {
+		t.Fatalf("bad: %d resets", cc.encoderResets)
+	}
+
+	// Messages written across resets are intact.
+	server := NewCodec(true, true, &bufConn{r: &conn.w})
+	for i, body := range bodies {
+		var req rpc.Request
+		if err := server.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out string
+		if err := server.ReadRequestBody(&out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if req.Seq != uint64(i) || out != body {
+			t.Fatalf("bad: message %d", i)
+		}
+	}
+}
+
+func TestCodec_ReadRequestHeaderBudget(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	client := NewCodec(false, false, clientConn)
+	server := NewCodec(true, true, serverConn)
+	defer server.Close()
+
+	// A request read within the budget clears the deadline, so a later
+	// request arriving after it has passed is still read.
+	go func() {
+		client.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 1}, "hello")
+		time.Sleep(100 * time.Millisecond)
+		client.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 2}, "hello")
+		// Send only the header of the next request, then stall.
+		client.Encode(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 3})
+	}()
+	var req rpc.Request
+	if err := server.ReadRequestHeaderBudget(&req, time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out string
+	if err := server.ReadRequestBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := server.ReadRequestBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Seq != 2 {
+		t.Fatalf("bad: %v", req)
+	}
+
+	// A stalled body runs out of budget.
+	if err := server.ReadRequestHeaderBudget(&req, time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Seq != 3 {
+		t.Fatalf("bad: %v", req)
+	}
+	if err := server.ReadRequestBody(&out); !isTimeout(err) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCodec_ReadRequestHeaderBudget_Prefix(t *testing.T) {
+	cases := map[string]struct {
+		header requestHeader
+		prefix interface{}
+		read   func(cc *MsgpackCodec) error
+	}{
+		"RequestID": {
+			header: requestHeader{ServiceMethod: "Test.Echo", Seq: 1, RequestID: true},
+			prefix: "trace-1",
+			read: func(cc *MsgpackCodec) error {
+				_, err := cc.ReadRequestID()
+				return err
+			},
+		},
+		"Metadata": {
+			header: requestHeader{ServiceMethod: "Test.Echo", Seq: 1, Metadata: true},
+			prefix: map[string]string{"a": "b"},
+			read: func(cc *MsgpackCodec) error {
+				_, err := cc.ReadRequestMetadata()
+				return err
+			},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			client := NewCodec(false, false, clientConn)
+			server := NewCodec(true, true, serverConn)
+			defer server.Close()
+
+			// Send the header and what comes before the body, then stall.
+			go func() {
+				client.Encode(&c.header)
+				client.Encode(c.prefix)
+			}()
+			var req rpc.Request
+			if err := server.ReadRequestHeaderBudget(&req, time.Now().Add(50*time.Millisecond)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := c.read(server); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			// Reading them doesn't clear the budget for the body.
+			errCh := make(chan error, 1)
+			go func() {
+				var out string
+				errCh <- server.ReadRequestBody(&out)
+			}()
+			select {
+			case err := <-errCh:
+				if !isTimeout(err) {
+					t.Fatalf("bad: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected body read to time out")
+			}
+		})
+	}
+}
+
+func TestCodec_EncodeToBytes(t *testing.T) {
+	type args struct {
+		Name string
+		Tags []string
+	}
+	in := args{Name: "foo", Tags: []string{"a", "b"}}
+
+	h := DefaultHandle()
+	h.Canonical = true
+	conn := &bufConn{}
+	cc := NewCodecFromHandle(false, false, conn, h)
+
+	encoded, err := cc.EncodeToBytes(&in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conn.w.Len() != 0 {
+		t.Fatalf("bad: %d bytes written", conn.w.Len())
+	}
+
+	// The cached bytes match what the codec writes itself.
+	if err := cc.Encode(&in); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(encoded, conn.w.Bytes()) {
+		t.Fatalf("bad: %x != %x", encoded, conn.w.Bytes())
+	}
+
+	var out args
+	if err := cc.DecodeFromBytes(encoded, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("bad: %#v", out)
+	}
+	if _, err := cc.EncodeToBytes(complex(1, 2)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// slowWriteConn delays each write.
+type slowWriteConn struct {
+	bufConn
+	delay time.Duration
+}
+
+func (c *slowWriteConn) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.bufConn.Write(p)
+}
+
+func TestCodec_SlowThreshold(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+
+	conn := &slowWriteConn{delay: 20 * time.Millisecond}
+	cc := New(conn, WithLogger(logger), WithSlowThreshold(10*time.Millisecond))
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 7}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(logs.String(), "slow write request for Test.Echo (seq 7) took") {
+		t.Fatalf("bad: %q", logs.String())
+	}
+
+	// Fast operations aren't logged.
+	logs.Reset()
+	conn.delay = 0
+	cc = New(conn, WithLogger(logger), WithSlowThreshold(time.Minute))
+	if err := cc.WriteResponse(&rpc.Response{ServiceMethod: "Test.Echo", Seq: 8}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var resp rpc.Response
+	client := New(&bufConn{r: &conn.w}, WithLogger(logger), WithSlowThreshold(time.Minute))
+	if err := client.ReadResponseHeader(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.ReadResponseBody(nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("bad: %q", logs.String())
+	}
+}
+
+func TestCodec_Magic(t *testing.T) {
+	magic := []byte("MPRPC1")
+	clientConn, serverConn := net.Pipe()
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(NewCodecWithMagic(serverConn, magic))
+	cc := NewCodecWithMagic(clientConn, magic)
+	defer cc.Close()
+	for i := 0; i < 2; i++ {
+		var out string
+		if err := CallWithCodec(cc, "TestService.Echo", "hello", &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out != "hello" {
+			t.Fatalf("bad: %q", out)
+		}
+	}
+
+	// Something else connecting is rejected.
+	conn := &bufConn{r: bytes.NewBufferString("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+	server := NewCodecWithMagic(conn, magic)
+	var req rpc.Request
+	if err := server.ReadRequestHeader(&req); err != ErrBadMagic {
+		t.Fatalf("bad: %v", err)
+	}
+	if !server.IsClosed() || !conn.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+
+	// A peer that hangs up straight away isn't reported as bad magic.
+	server = NewCodecWithMagic(&bufConn{r: new(bytes.Buffer)}, magic)
+	if err := server.ReadRequestHeader(&req); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestValidateEncodable(t *testing.T) {
+	type args struct {
+		Name  string
+		Value interface{}
+	}
+	cc := NewCodec(false, false, &bufConn{})
+	cases := []struct {
+		v  interface{}
+		ok bool
+	}{
+		{"hello", true},
+		{&args{Name: "foo", Value: []int{1, 2}}, true},
+		{&args{Name: "foo"}, true},
+		{complex(1, 2), false},
+		{&args{Name: "foo", Value: complex(1, 2)}, false},
+		{map[string]interface{}{"a": complex64(1)}, false},
+	}
+	for i, tc := range cases {
+		if err := ValidateEncodable(tc.v); (err == nil) != tc.ok {
+			t.Fatalf("bad: %d %v", i, err)
+		}
+		if err := cc.ValidateEncodable(tc.v); (err == nil) != tc.ok {
+			t.Fatalf("bad: %d %v", i, err)
+		}
+	}
+}
+
+func TestCodec_ReadRequestBodyInto(t *testing.T) {
+	type putArgs struct {
+		Key   string
+		Value []byte
+	}
+	type getArgs struct {
+		Key string
+	}
+	registry := map[string]reflect.Type{
+		"KV.Put":    reflect.TypeOf(putArgs{}),
+		"KV.Get":    reflect.TypeOf(&getArgs{}),
+		"KV.Delete": reflect.TypeOf(""),
+		"KV.List":   nil,
+	}
+
+	conn := &bufConn{}
+	client := NewCodec(false, false, conn)
+	requests := []struct {
+		method string
+		body   interface{}
+	}{
+		{"KV.Put", &putArgs{Key: "a", Value: []byte("1")}},
+		{"KV.Get", &getArgs{Key: "a"}},
+		{"KV.Delete", "a"},
+		{"KV.List", map[string]int{"limit": 10}},
+		{"KV.Get", &getArgs{Key: "b"}},
+	}
+	for i, req := range requests {
+		if err := client.WriteRequest(&rpc.Request{ServiceMethod: req.method, Seq: uint64(i)}, req.body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	server := NewCodec(false, false, &bufConn{r: &conn.w})
+	var got []interface{}
+	for range requests {
+		var req rpc.Request
+		if err := server.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		body, err := server.ReadRequestBodyInto(registry[req.ServiceMethod])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		got = append(got, body)
+	}
+	expected := []interface{}{
+		putArgs{Key: "a", Value: []byte("1")},
+		&getArgs{Key: "a"},
+		"a",
+		nil,
+		&getArgs{Key: "b"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+}
+
+func TestCodec_SetOnClose(t *testing.T) {
+	var calls int32
+	onClose := func() { atomic.AddInt32(&calls, 1) }
+
+	// An explicit close calls it once, however many times it is closed.
+	cc := NewCodec(true, true, &bufConn{})
+	cc.SetOnClose(onClose)
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Fatalf("called before close")
+	}
+	cc.Close()
+	cc.Close()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("bad: %d calls", n)
+	}
+
+	// A failed response write closes the codec and calls it on another
+	// goroutine, where it can use the codec without deadlocking.
+	cc = NewCodec(true, true, &failingWriteConn{})
+	calledCh := make(chan error, 1)
+	cc.SetOnClose(func() {
+		calledCh <- cc.WriteResponse(&rpc.Response{ServiceMethod: "Test.Method", Seq: 2}, "hello")
+	})
+	if err := cc.WriteResponse(&rpc.Response{ServiceMethod: "Test.Method", Seq: 1}, "hello"); err == nil {
+		t.Fatalf("expected error")
+	}
+	cc.Close()
+	select {
+	case err := <-calledCh:
+		if err != io.EOF {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected callback to be called")
+	}
+
+	// So can a callback run by Close.
+	cc = NewCodec(true, true, &bufConn{})
+	cc.SetOnClose(func() {
+		calledCh <- cc.WriteResponse(&rpc.Response{ServiceMethod: "Test.Method", Seq: 1}, "hello")
+	})
+	cc.Close()
+	if err := <-calledCh; err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Setting it on a closed codec calls it straight away.
+	atomic.StoreInt32(&calls, 0)
+	cc.SetOnClose(onClose)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("bad: %d calls", n)
+	}
+
+	// Racing closes still call it exactly once.
+	atomic.StoreInt32(&calls, 0)
+	cc = NewCodec(true, true, &bufConn{})
+	cc.SetOnClose(onClose)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc.Close()
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("bad: %d calls", n)
+	}
+}
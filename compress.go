@@ -0,0 +1,262 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// CompressWriter is a compressing writer that can flush its pending output
+// without ending the stream.
+type CompressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressorFactory creates the compressing writer and decompressing reader
+// used by a codec created with NewCompressedCodec. This allows any
+// compression library to be used without this package depending on it. For
+// example, a zstd factory can wrap the encoder and decoder from
+// github.com/klauspost/compress/zstd.
+type CompressorFactory interface {
+	// NewWriter returns a writer that compresses to w.
+	NewWriter(w io.Writer) (CompressWriter, error)
+
+	// NewReader returns a reader that decompresses from r. It is called on
+	// the first read from the connection, so it may block reading a
+	// stream header.
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// GzipCompressor is a CompressorFactory that uses compress/gzip with the
+// given compression level. Note that the zero value is
+// gzip.NoCompression.
+type GzipCompressor struct {
+	Level int
+}
+
+func (g GzipCompressor) NewWriter(w io.Writer) (CompressWriter, error) {
+	return gzip.NewWriterLevel(w, g.Level)
+}
+
+func (g GzipCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// NewCompressedCodec returns a MsgpackCodec that compresses everything
+// written to conn and decompresses everything read from it, using the
+// compressor from factory. Both ends of the connection must use the same
+// compression. The compressed stream is flushed after every request and
+// response so the peer can decode it without waiting for more data.
+func NewCompressedCodec(bufReads, bufWrites bool, conn io.ReadWriteCloser, factory CompressorFactory) (*MsgpackCodec, error) {
+	zw, err := factory.NewWriter(conn)
+	if err != nil {
+		return nil, err
+	}
+	cc := &compressConn{
+		conn:         conn,
+		factory:      factory,
+		zw:           zw,
+		closeTimeout: compressCloseTimeout,
+	}
+	return NewCodec(bufReads, bufWrites, cc), nil
+}
+
+// NewGzipCodec returns a MsgpackCodec that compresses the connection with
+// gzip at the given level. It is the same as NewCompressedCodec with a
+// GzipCompressor.
+func NewGzipCodec(bufReads, bufWrites bool, level int, conn io.ReadWriteCloser) (*MsgpackCodec, error) {
+	return NewCompressedCodec(bufReads, bufWrites, conn, GzipCompressor{Level: level})
+}
+
+// compressCloseTimeout is how long Close waits to write the end of the
+// compressed stream.
+const compressCloseTimeout = time.Second
+
+// compressConn compresses writes to and decompresses reads from a
+// connection.
+type compressConn struct {
+	conn    io.ReadWriteCloser
+	factory CompressorFactory
+
+	zw           CompressWriter
+	zwLock       sync.Mutex
+	closeTimeout time.Duration
+
+	// zr is created on the first read since creating it may block until
+	// the peer has written a stream header.
+	zr     io.Reader
+	zrLock sync.Mutex
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	c.zrLock.Lock()
+	defer c.zrLock.Unlock()
+	if c.zr == nil {
+		zr, err := c.factory.NewReader(c.conn)
+		if err != nil {
+			return 0, err
+		}
+		c.zr = zr
+	}
+	return c.zr.Read(p)
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	c.zwLock.Lock()
+	defer c.zwLock.Unlock()
+	return c.zw.Write(p)
+}
+
+// Flush flushes any pending compressed data to the connection.
+func (c *compressConn) Flush() error {
+	c.zwLock.Lock()
+	defer c.zwLock.Unlock()
+	return c.zw.Flush()
+}
+
+// Close ends the compressed stream so the peer sees a clean end of stream,
+// and then closes the connection. The end of the stream is skipped if a
+// write is in progress, and given up on after closeTimeout if the peer isn't
+// reading, since either may be stuck on a dead peer and closing the
+// connection is what unblocks it.
+func (c *compressConn) Close() error {
+	if c.zwLock.TryLock() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer c.zwLock.Unlock()
+			c.zw.Close()
+		}()
+		timer := time.NewTimer(c.closeTimeout)
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	return c.conn.Close()
+}
+
+const (
+	// envelopeRaw marks an enveloped body that is not compressed.
+	envelopeRaw uint8 = 0
+
+	// envelopeCompressed marks an enveloped body that is compressed.
+	envelopeCompressed uint8 = 1
+)
+
+// DefaultMaxDecompressedSize is the largest body decompressed by
+// ReadRequestBodyMaybeCompressed.
+const DefaultMaxDecompressedSize = 64 * 1024 * 1024
+
+// ErrDecompressedTooLarge is returned when a compressed request body
+// decompresses to more than the limit allowed by the reader.
+var ErrDecompressedTooLarge = errors.New("msgpackrpc: decompressed body exceeds the maximum size")
+
+// WriteRequestMaybeCompressed writes a request whose body is wrapped in an
+// envelope that allows it to be compressed. The body is only compressed,
+// using factory, if its encoded size exceeds threshold bytes, so small bodies
+// don't pay the cost of compression. The peer must read the body with
+// ReadRequestBodyMaybeCompressed.
+//
+// The envelope is written in place of the body and consists of two msgpack
+// values. The first is an unsigned integer flag. If the flag is 0, the second
+// value is the body encoded as usual. If the flag is 1, the second value is a
+// msgpack bin or str holding the compressed msgpack encoding of the body.
+//
+// If the write fails, the codec is closed, as with WriteRequest.
+func (cc *MsgpackCodec) WriteRequestMaybeCompressed(r *rpc.Request, body interface{}, factory CompressorFactory, threshold int) error {
+	if err := cc.validateMethod(r.ServiceMethod); err != nil {
+		return err
+	}
+	var encoded []byte
+	if err := codec.NewEncoderBytes(&encoded, cc.h).Encode(body); err != nil {
+		return err
+	}
+
+	flag, payload := envelopeRaw, interface{}(PreEncoded(encoded))
+	if len(encoded) > threshold {
+		var buf bytes.Buffer
+		zw, err := factory.NewWriter(&buf)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(encoded); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		flag, payload = envelopeCompressed, buf.Bytes()
+	}
+
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	err := cc.write(r, flag, payload)
+	if err != nil {
+		cc.closeConn()
+	}
+	return err
+}
+
+// ReadRequestBodyMaybeCompressed reads a request body written with
+// WriteRequestMaybeCompressed, decompressing it with factory if needed. A
+// body that decompresses to more than DefaultMaxDecompressedSize bytes fails
+// with ErrDecompressedTooLarge.
+func (cc *MsgpackCodec) ReadRequestBodyMaybeCompressed(out interface{}, factory CompressorFactory) error {
+	return cc.ReadRequestBodyMaybeCompressedLimit(out, factory, DefaultMaxDecompressedSize)
+}
+
+// ReadRequestBodyMaybeCompressedLimit is the same as
+// ReadRequestBodyMaybeCompressed, but fails with ErrDecompressedTooLarge if
+// the body decompresses to more than maxSize bytes, rather than
+// DefaultMaxDecompressedSize. A small compressed body can expand to a huge
+// one, so this keeps a peer from exhausting memory with one. The compressed
+// body has already been read when the limit is hit, so the codec remains
+// usable for the next request.
+func (cc *MsgpackCodec) ReadRequestBodyMaybeCompressedLimit(out interface{}, factory CompressorFactory, maxSize int) error {
+	var flag uint8
+	if err := cc.readAt(readBody, readBody, &flag); err != nil {
+		return err
+	}
+	switch flag {
+	case envelopeRaw:
+		return cc.readAt(readBody, readHeader, out)
+	case envelopeCompressed:
+		var compressed []byte
+		if err := cc.readAt(readBody, readHeader, &compressed); err != nil {
+			return err
+		}
+		zr, err := factory.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return err
+		}
+		encoded, err := io.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+		if err != nil {
+			return err
+		}
+		if len(encoded) > maxSize {
+			return ErrDecompressedTooLarge
+		}
+		if out == nil {
+			return nil
+		}
+		return codec.NewDecoderBytes(encoded, cc.h).Decode(out)
+	default:
+		if err := cc.readAt(readBody, readHeader, nil); err != nil {
+			return err
+		}
+		return fmt.Errorf("msgpackrpc: unknown body envelope flag %d", flag)
+	}
+}
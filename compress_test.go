@@ -0,0 +1,265 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGzipCodec_RoundTrip(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sc, err := NewGzipCodec(true, true, gzip.BestSpeed, serverConn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(sc)
+
+	cc, err := NewGzipCodec(true, true, gzip.BestSpeed, clientConn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cc.Close()
+
+	for i := 0; i < 3; i++ {
+		args := strings.Repeat("hello ", 100*(i+1))
+		var resp string
+		if err := CallWithCodec(cc, "TestService.Echo", args, &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp != args {
+			t.Fatalf("bad: %q", resp)
+		}
+	}
+}
+
+func TestGzipCodec_Close(t *testing.T) {
+	// The end of the stream is written, so the peer sees a clean EOF.
+	conn := &bufConn{}
+	cc, err := NewGzipCodec(true, true, gzip.BestSpeed, conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Method", Seq: 1}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := cc.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	zr, err := gzip.NewReader(&conn.w)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadAll(zr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// closeWithin checks that closing the codec doesn't hang.
+	closeWithin := func(t *testing.T, cc *MsgpackCodec) {
+		t.Helper()
+		errCh := make(chan error, 1)
+		go func() { errCh <- cc.Close() }()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected close to return")
+		}
+	}
+
+	// A peer that isn't reading doesn't block Close for long.
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	cc, err = NewGzipCodec(false, false, gzip.BestSpeed, clientConn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cc.conn.(*compressConn).closeTimeout = 10 * time.Millisecond
+	closeWithin(t, cc)
+	var buf [1]byte
+	if _, err := serverConn.Read(buf[:]); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Nor does a write in progress.
+	clientConn, serverConn = net.Pipe()
+	defer serverConn.Close()
+	cc, err = NewGzipCodec(false, false, gzip.BestSpeed, clientConn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	zc := cc.conn.(*compressConn)
+	zc.zwLock.Lock()
+	defer zc.zwLock.Unlock()
+	closeWithin(t, cc)
+}
+
+func TestGzipCodec_BadLevel(t *testing.T) {
+	if _, err := NewGzipCodec(true, true, 42, &bufConn{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+type benchRecord struct {
+	ID        int64
+	Name      string
+	Namespace string
+	Tags      map[string]string
+	Addresses []string
+}
+
+// EchoRecords is used by the compression benchmarks.
+func (s *TestService) EchoRecords(args []benchRecord, resp *[]benchRecord) error {
+	*resp = args
+	return nil
+}
+
+func benchmarkCompression(b *testing.B, newCodec func(conn io.ReadWriteCloser) (*MsgpackCodec, error)) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	sc, err := newCodec(serverConn)
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(sc)
+
+	cc, err := newCodec(clientConn)
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer cc.Close()
+
+	args := make([]benchRecord, 50)
+	for i := range args {
+		args[i] = benchRecord{
+			ID:        int64(i),
+			Name:      fmt.Sprintf("service-%d", i),
+			Namespace: "default",
+			Tags:      map[string]string{"env": "production", "region": "us-east-1"},
+			Addresses: []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var resp []benchRecord
+		if err := CallWithCodec(cc, "TestService.EchoRecords", args, &resp); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkCompression_None(b *testing.B) {
+	benchmarkCompression(b, func(conn io.ReadWriteCloser) (*MsgpackCodec, error) {
+		return NewCodec(true, true, conn), nil
+	})
+}
+
+func BenchmarkCompression_Gzip(b *testing.B) {
+	benchmarkCompression(b, func(conn io.ReadWriteCloser) (*MsgpackCodec, error) {
+		return NewCompressedCodec(true, true, conn, GzipCompressor{Level: gzip.BestSpeed})
+	})
+}
+
+func TestCodec_MaybeCompressed(t *testing.T) {
+	factory := GzipCompressor{Level: gzip.BestSpeed}
+	small, large := "hello", strings.Repeat("hello ", 1000)
+
+	conn := &bufConn{}
+	cc := NewCodec(true, true, conn)
+	for _, body := range []string{small, large} {
+		req := rpc.Request{ServiceMethod: "Test.Method"}
+		if err := cc.WriteRequestMaybeCompressed(&req, body, factory, 100); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if conn.w.Len() > len(large)/2 {
+		t.Fatalf("expected large body to be compressed, wrote %d bytes", conn.w.Len())
+	}
+
+	reader := NewCodec(true, true, &bufConn{r: &conn.w})
+	for _, expected := range []string{small, large} {
+		var req rpc.Request
+		if err := reader.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out string
+		if err := reader.ReadRequestBodyMaybeCompressed(&out, factory); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out != expected {
+			t.Fatalf("bad: %q", out)
+		}
+	}
+}
+
+func TestCodec_MaybeCompressedLimit(t *testing.T) {
+	factory := GzipCompressor{Level: gzip.BestSpeed}
+	large := strings.Repeat("hello ", 1000)
+
+	conn := &bufConn{}
+	cc := NewCodec(true, true, conn)
+	for _, body := range []string{large, "hello"} {
+		if err := cc.WriteRequestMaybeCompressed(&rpc.Request{ServiceMethod: "Test.Method"}, body, factory, 100); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The body compresses well, but decompresses to more than the limit.
+	reader := NewCodec(true, true, &bufConn{r: &conn.w})
+	var req rpc.Request
+	if err := reader.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out string
+	if err := reader.ReadRequestBodyMaybeCompressedLimit(&out, factory, 1024); err != ErrDecompressedTooLarge {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The stream is still aligned for the next request.
+	if err := reader.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := reader.ReadRequestBodyMaybeCompressedLimit(&out, factory, 1024); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestCodec_MaybeCompressed_WriteError(t *testing.T) {
+	conn := &failingWriteConn{}
+	cc := NewCodec(true, true, conn)
+
+	// A failed write may leave part of the request on the connection, so
+	// the codec is closed.
+	req := rpc.Request{ServiceMethod: "Test.Method", Seq: 1}
+	if err := cc.WriteRequestMaybeCompressed(&req, "hello", GzipCompressor{}, 100); err == nil {
+		t.Fatalf("expected error")
+	}
+	if !cc.IsClosed() || !conn.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"sync"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// requestCodec is an rpc.ServerCodec for a single request that has already
+// been read from a connection. It lets a custom serve loop hand a request to
+// rpc.Server.ServeRequest, which calls the handler synchronously, while
+// responses are written back through the connection's codec.
+type requestCodec struct {
+	cc   *MsgpackCodec
+	req  rpc.Request
+	body codec.Raw
+
+	// metadata is the metadata sent with the request, if any.
+	metadata map[string]string
+
+	responded bool
+
+	// respErr is the error sent in the response, if any.
+	respErr string
+}
+
+func (rc *requestCodec) ReadRequestHeader(r *rpc.Request) error {
+	*r = rc.req
+	return nil
+}
+
+func (rc *requestCodec) ReadRequestBody(out interface{}) error {
+	if out == nil {
+		return nil
+	}
+	return codec.NewDecoderBytes(rc.body, rc.cc.h).Decode(out)
+}
+
+func (rc *requestCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	rc.responded = true
+	rc.respErr = r.Error
+	return rc.cc.WriteResponse(r, body)
+}
+
+// Close is a no-op, the connection is closed by the serve loop.
+func (rc *requestCodec) Close() error {
+	return nil
+}
+
+// writeError sends an error response for the request, unless a response
+// has already been written.
+func (rc *requestCodec) writeError(msg string) error {
+	if rc.responded {
+		return nil
+	}
+	resp := rpc.Response{
+		ServiceMethod: rc.req.ServiceMethod,
+		Seq:           rc.req.Seq,
+		Error:         msg,
+	}
+	return rc.WriteResponse(&resp, struct{}{})
+}
+
+// serveRequests reads requests from cc until the connection fails, calling
+// dispatch for each in its own goroutine. The context passed to dispatch is
+// cancelled once the connection fails, and then it waits for all
+// outstanding requests to finish and closes the codec.
+func serveRequests(cc *MsgpackCodec, dispatch func(ctx context.Context, rc *requestCodec)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for {
+		rc := &requestCodec{cc: cc}
+		err := cc.ReadRequestHeader(&rc.req)
+		if err == nil {
+			err = cc.ReadRequestBody(&rc.body)
+			rc.metadata = cc.reqMetadata
+		}
+		if err != nil {
+			if err != io.EOF && cc.logger != nil {
+				cc.logger.Printf("[ERR] msgpackrpc: failed to read request: %v", err)
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatch(ctx, rc)
+		}()
+	}
+	cancel()
+	wg.Wait()
+	cc.Close()
+}
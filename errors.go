@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/rpc"
+	"strings"
+)
+
+// structuredErrorPrefix marks an error string produced by EncodeError.
+const structuredErrorPrefix = "msgpackrpc-error:"
+
+// StructuredError is an error with a code and details that can be sent
+// across net/rpc, which only carries a string in rpc.Response.Error. Servers
+// encode it with EncodeError and clients decode it with DecodeError.
+type StructuredError struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e *StructuredError) Error() string {
+	return e.Message
+}
+
+// EncodeError returns the string to send for err as an RPC error. If err is
+// or wraps a *StructuredError, its code and details are encoded so they can
+// be recovered with DecodeError. Otherwise the plain error message is
+// returned. A handler returns the result with:
+//
+//	return errors.New(msgpackrpc.EncodeError(err))
+func EncodeError(err error) string {
+	var se *StructuredError
+	if !errors.As(err, &se) {
+		return err.Error()
+	}
+	buf, jsonErr := json.Marshal(se)
+	if jsonErr != nil {
+		return err.Error()
+	}
+	return structuredErrorPrefix + string(buf)
+}
+
+// DecodeError is the inverse of EncodeError. It returns a *StructuredError
+// if s was encoded from one, and an rpc.ServerError otherwise. It can be set
+// as the ErrorDecoder of a CallerSeq.
+func DecodeError(s string) error {
+	if !strings.HasPrefix(s, structuredErrorPrefix) {
+		return rpc.ServerError(s)
+	}
+	var se StructuredError
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(s, structuredErrorPrefix)), &se); err != nil {
+		return rpc.ServerError(s)
+	}
+	return &se
+}
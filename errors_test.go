@@ -0,0 +1,68 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeError_RoundTrip(t *testing.T) {
+	handler := func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error) {
+		if err := dec(nil); err != nil {
+			return nil, err
+		}
+		switch method {
+		case "Test.Structured":
+			err := fmt.Errorf("lookup failed: %w", &StructuredError{
+				Code:    404,
+				Message: "not found",
+				Details: map[string]string{"key": "foo"},
+			})
+			return nil, errors.New(EncodeError(err))
+		case "Test.Plain":
+			return nil, errors.New(EncodeError(errors.New("boom")))
+		case "Test.BadJSON":
+			return nil, errors.New(structuredErrorPrefix + "{not json")
+		}
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+	clientConn, serverConn := net.Pipe()
+	go ServeConnCtx(serverConn, handler)
+	cc := NewCodec(true, true, clientConn)
+	defer cc.Close()
+	caller := &CallerSeq{ErrorDecoder: DecodeError}
+
+	// A wrapped *StructuredError arrives with its code and details.
+	err := caller.CallWithCodec(cc, "Test.Structured", nil, nil)
+	se, ok := err.(*StructuredError)
+	if !ok {
+		t.Fatalf("bad: %#v", err)
+	}
+	expected := &StructuredError{
+		Code:    404,
+		Message: "not found",
+		Details: map[string]string{"key": "foo"},
+	}
+	if !reflect.DeepEqual(se, expected) {
+		t.Fatalf("bad: %#v", se)
+	}
+
+	// A plain error arrives as an rpc.ServerError.
+	err = caller.CallWithCodec(cc, "Test.Plain", nil, nil)
+	if err != rpc.ServerError("boom") {
+		t.Fatalf("bad: %#v", err)
+	}
+
+	// So does a string with the prefix that isn't valid JSON.
+	err = caller.CallWithCodec(cc, "Test.BadJSON", nil, nil)
+	if err != rpc.ServerError(structuredErrorPrefix+"{not json") {
+		t.Fatalf("bad: %#v", err)
+	}
+}
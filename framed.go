@@ -0,0 +1,105 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// ErrFrameTooLarge is returned when a framed codec reads a frame whose
+// length is over its limit. The connection can't be read any further, since
+// the frame hasn't been consumed.
+var ErrFrameTooLarge = errors.New("msgpackrpc: frame exceeds the maximum size")
+
+// DefaultMaxFrameSize is the largest frame read by a codec from
+// NewFramedCodec.
+const DefaultMaxFrameSize = 64 * 1024 * 1024
+
+// NewFramedCodec returns a MsgpackCodec that prefixes each encoded value
+// with its length as a 4 byte big-endian integer, for peers that frame
+// messages this way. Each request or response is two frames, one for the
+// header and one for the body. A framed codec can only talk to another
+// framed codec, it is not compatible with the unframed default codec.
+// Frames larger than DefaultMaxFrameSize are rejected with ErrFrameTooLarge.
+func NewFramedCodec(bufReads, bufWrites bool, conn io.ReadWriteCloser) *MsgpackCodec {
+	return NewFramedCodecWithLimit(bufReads, bufWrites, conn, DefaultMaxFrameSize)
+}
+
+// NewFramedCodecWithLimit is the same as NewFramedCodec, but rejects frames
+// larger than maxFrameSize bytes rather than DefaultMaxFrameSize. The length
+// of each frame comes from the peer, so the limit keeps a bad or malicious
+// one from making the codec allocate up to 4GB for a single frame. A
+// maxFrameSize of zero or less applies no limit.
+func NewFramedCodecWithLimit(bufReads, bufWrites bool, conn io.ReadWriteCloser, maxFrameSize int) *MsgpackCodec {
+	cc := NewCodec(bufReads, bufWrites, conn)
+	var r io.Reader = conn
+	if cc.bufR != nil {
+		r = cc.bufR
+	}
+	cc.enc = &framedEncoder{w: cc.w, h: cc.h}
+	cc.dec = &framedDecoder{r: r, h: cc.h, max: maxFrameSize}
+	return cc
+}
+
+// framedEncoder encodes each value to a buffer so that it can be written
+// after its length.
+type framedEncoder struct {
+	w   io.Writer
+	h   codec.Handle
+	buf []byte
+}
+
+func (e *framedEncoder) Encode(v interface{}) error {
+	e.buf = e.buf[:0]
+	if err := codec.NewEncoderBytes(&e.buf, e.h).Encode(v); err != nil {
+		return err
+	}
+	return e.EncodeRaw(e.buf)
+}
+
+func (e *framedEncoder) EncodeRaw(raw []byte) error {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(raw)))
+	if _, err := e.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(raw)
+	return err
+}
+
+// framedDecoder reads a length prefixed frame and decodes the value in it.
+type framedDecoder struct {
+	r   io.Reader
+	h   codec.Handle
+	buf []byte
+
+	// max is the largest frame accepted, if positive.
+	max int
+}
+
+func (d *framedDecoder) Decode(v interface{}) error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(d.r, prefix[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if d.max > 0 && uint64(n) > uint64(d.max) {
+		return ErrFrameTooLarge
+	}
+	if uint32(cap(d.buf)) < n {
+		d.buf = make([]byte, n)
+	}
+	d.buf = d.buf[:n]
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return codec.NewDecoderBytes(d.buf, d.h).Decode(v)
+}
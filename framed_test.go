@@ -0,0 +1,92 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+func TestFramedCodec_RoundTrip(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(NewFramedCodec(true, true, serverConn))
+
+	cc := NewFramedCodec(true, true, clientConn)
+	defer cc.Close()
+	for _, args := range []string{"hello", "", "world"} {
+		var resp string
+		if err := CallWithCodec(cc, "TestService.Echo", args, &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp != args {
+			t.Fatalf("bad: %q", resp)
+		}
+	}
+
+	var resp string
+	err := CallWithCodec(cc, "TestService.Fail", "boom", &resp)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "boom" {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestFramedCodec_Format(t *testing.T) {
+	conn := &bufConn{}
+	cc := NewFramedCodec(false, false, conn)
+	req := rpc.Request{ServiceMethod: "Test.Method", Seq: 1}
+	if err := cc.WriteRequest(&req, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	buf := conn.w.Bytes()
+	for _, expected := range []interface{}{&req, "hello"} {
+		n := binary.BigEndian.Uint32(buf)
+		var frame []byte
+		if err := codec.NewEncoderBytes(&frame, msgpackHandle).Encode(expected); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if int(n) != len(frame) || string(buf[4:4+n]) != string(frame) {
+			t.Fatalf("bad frame: %v", buf[:4+n])
+		}
+		buf = buf[4+n:]
+	}
+	if len(buf) != 0 {
+		t.Fatalf("unexpected trailing data: %v", buf)
+	}
+}
+
+func TestFramedCodec_MaxFrameSize(t *testing.T) {
+	conn := &bufConn{}
+	NewFramedCodec(false, false, conn).WriteRequest(&rpc.Request{ServiceMethod: "Test.Method", Seq: 1}, strings.Repeat("a", 100))
+
+	// The header frame fits, but the body frame doesn't.
+	cc := NewFramedCodecWithLimit(false, false, &bufConn{r: &conn.w}, 64)
+	var req rpc.Request
+	if err := cc.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var body string
+	if err := cc.ReadRequestBody(&body); err != ErrFrameTooLarge {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// A frame claiming to be huge is rejected without being read.
+	huge := &bufConn{r: bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})}
+	cc = NewFramedCodec(false, false, huge)
+	if err := cc.ReadRequestHeader(&req); err != ErrFrameTooLarge {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+)
+
+// ErrVersionMismatch is returned by DialWithHandshake and
+// ServeConnWithHandshake if the peer doesn't speak a compatible version of
+// the protocol. The returned error wraps it with the details, so it should be
+// checked with errors.Is.
+var ErrVersionMismatch = errors.New("msgpackrpc: protocol version mismatch")
+
+// The handshake frame is exchanged before any requests are sent on a
+// connection. It is 8 bytes long:
+//
+//	bytes 0-3: the magic "MRPC"
+//	byte  4:   the handshake version, currently 1
+//	byte  5:   the wire format, see below
+//	bytes 6-7: reserved, must be zero
+//
+// The only wire format defined is 1, which is msgpack as encoded by
+// github.com/hashicorp/go-msgpack/v2 with the default handle. New formats
+// will be given new numbers, so that peers which would misread each other's
+// encoding fail at the handshake rather than with garbled decode errors.
+//
+// The client writes its frame first, and the server replies with its own
+// frame whether or not they match, so that both sides can report the
+// mismatch.
+const (
+	handshakeLen     = 8
+	handshakeMagic   = "MRPC"
+	handshakeVersion = 1
+	handshakeFormat  = 1
+)
+
+// handshakeFrame returns the handshake frame for this side of a connection.
+func handshakeFrame() []byte {
+	frame := make([]byte, handshakeLen)
+	copy(frame, handshakeMagic)
+	frame[4] = handshakeVersion
+	frame[5] = handshakeFormat
+	return frame
+}
+
+// readHandshake reads the peer's handshake frame from conn and checks that
+// it is compatible. A peer that doesn't support the handshake typically
+// closes the connection when it fails to decode the frame as a request, so
+// that is reported as a mismatch too.
+func readHandshake(conn io.Reader) error {
+	frame := make([]byte, handshakeLen)
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: peer closed the connection during the handshake", ErrVersionMismatch)
+		}
+		return err
+	}
+	if !bytes.Equal(frame[:4], []byte(handshakeMagic)) {
+		return fmt.Errorf("%w: peer did not send a handshake", ErrVersionMismatch)
+	}
+	if frame[4] != handshakeVersion || frame[5] != handshakeFormat {
+		return fmt.Errorf("%w: peer has handshake version %d format %d, expected version %d format %d",
+			ErrVersionMismatch, frame[4], frame[5], handshakeVersion, handshakeFormat)
+	}
+	return nil
+}
+
+// DialWithHandshake connects to a MessagePack-RPC server at the specified
+// network address and exchanges a handshake frame with it before returning
+// the client. The server must be serving the connection with
+// ServeConnWithHandshake. If the server's version or wire format isn't
+// compatible, the connection is closed and an error wrapping
+// ErrVersionMismatch is returned.
+func DialWithHandshake(network, address string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := clientHandshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// clientHandshake sends the client's handshake frame on conn and checks the
+// server's reply.
+func clientHandshake(conn io.ReadWriter) error {
+	if _, err := conn.Write(handshakeFrame()); err != nil {
+		return err
+	}
+	return readHandshake(conn)
+}
+
+// ServeConnWithHandshake exchanges a handshake frame with a client
+// connected with DialWithHandshake, and then serves the connection like
+// ServeConn. If the client's version or wire format isn't compatible, the
+// connection is closed and an error wrapping ErrVersionMismatch is returned.
+func ServeConnWithHandshake(conn io.ReadWriteCloser) error {
+	err := readHandshake(conn)
+	// Reply even on a mismatch, so the client can report it too.
+	if _, writeErr := conn.Write(handshakeFrame()); err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	ServeConn(conn)
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	registerDefault(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- ServeConnWithHandshake(conn)
+	}()
+
+	client, err := DialWithHandshake("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out string
+	if err := client.Call("TestService.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+	client.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestHandshake_Mismatch(t *testing.T) {
+	registerDefault(t)
+
+	// A client with a newer wire format is rejected by the server, and sees
+	// the server's frame so it can report the mismatch too.
+	clientConn, serverConn := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ServeConnWithHandshake(serverConn)
+	}()
+	frame := handshakeFrame()
+	frame[5] = handshakeFormat + 1
+	if _, err := clientConn.Write(frame); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := readHandshake(clientConn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-errCh; !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// A server that doesn't support the handshake fails to decode the
+	// frame as a request and hangs up.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			ServeConn(conn)
+		}
+	}()
+	if _, err := DialWithHandshake("tcp", l.Addr().String()); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"time"
+)
+
+// Invoker makes a call to method, decoding the result into resp.
+type Invoker func(method string, args, resp interface{}) error
+
+// ClientInterceptor wraps an Invoker with extra behavior, such as logging,
+// injecting an auth token into the arguments or retrying, and calls next to
+// continue the call.
+type ClientInterceptor func(next Invoker) Invoker
+
+// ChainedCaller makes calls with CallWithCodec through a chain of
+// interceptors. Like CallWithCodec, it must not be used for concurrent
+// calls on the same codec.
+type ChainedCaller struct {
+	invoke Invoker
+}
+
+// NewChainedCaller returns a ChainedCaller that makes calls on cc through
+// interceptors. The first interceptor is the outermost, so it sees each
+// call first and its result last.
+func NewChainedCaller(cc rpc.ClientCodec, interceptors ...ClientInterceptor) *ChainedCaller {
+	invoke := Invoker(func(method string, args, resp interface{}) error {
+		return CallWithCodec(cc, method, args, resp)
+	})
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		invoke = interceptors[i](invoke)
+	}
+	return &ChainedCaller{invoke: invoke}
+}
+
+// Call calls method through the interceptors.
+func (c *ChainedCaller) Call(method string, args, resp interface{}) error {
+	return c.invoke(method, args, resp)
+}
+
+// LatencyInterceptor returns a ClientInterceptor that logs how long each
+// call took, along with its error if it failed.
+func LatencyInterceptor(logger Logger) ClientInterceptor {
+	return func(next Invoker) Invoker {
+		return func(method string, args, resp interface{}) error {
+			start := time.Now()
+			err := next(method, args, resp)
+			if err != nil {
+				logger.Printf("[DEBUG] msgpackrpc: %s failed after %v: %v", method, time.Since(start), err)
+			} else {
+				logger.Printf("[DEBUG] msgpackrpc: %s took %v", method, time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// ServerHandler serves a request for method. It returns the error sent to
+// the client as an rpc.ServerError, or nil if the call succeeded.
+type ServerHandler func(method string) error
+
+// ServerInterceptor wraps a ServerHandler with extra behavior, such as
+// logging, authorization checks or metrics, and calls next to continue
+// serving the request. If it returns an error without calling next, the
+// error is sent to the client in place of calling the handler.
+type ServerInterceptor func(next ServerHandler) ServerHandler
+
+// ServeWithInterceptors runs the MessagePack-RPC server on a single
+// connection, calling methods registered on srv through interceptors. The
+// first interceptor is the outermost. Like ServeConn, it blocks serving the
+// connection until the client hangs up, and requests are handled
+// concurrently.
+func ServeWithInterceptors(conn io.ReadWriteCloser, srv *rpc.Server, interceptors ...ServerInterceptor) {
+	serveRequests(NewCodec(true, true, conn), func(_ context.Context, rc *requestCodec) {
+		handle := ServerHandler(func(method string) error {
+			err := srv.ServeRequest(rc)
+			if rc.respErr != "" {
+				return rpc.ServerError(rc.respErr)
+			}
+			return err
+		})
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			handle = interceptors[i](handle)
+		}
+		if err := handle(rc.req.ServiceMethod); err != nil {
+			rc.writeError(err.Error())
+		}
+	})
+}
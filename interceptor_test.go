@@ -0,0 +1,130 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChainedCaller(t *testing.T) {
+	cc := testServer(t)
+
+	var order []string
+	record := func(name string) ClientInterceptor {
+		return func(next Invoker) Invoker {
+			return func(method string, args, resp interface{}) error {
+				order = append(order, name+" before "+method)
+				err := next(method, args, resp)
+				order = append(order, name+" after "+method)
+				return err
+			}
+		}
+	}
+	// Rewrite the arguments on the way in.
+	upper := func(next Invoker) Invoker {
+		return func(method string, args, resp interface{}) error {
+			return next(method, strings.ToUpper(args.(string)), resp)
+		}
+	}
+
+	var buf bytes.Buffer
+	caller := NewChainedCaller(cc, record("outer"), LatencyInterceptor(log.New(&buf, "", 0)), record("inner"), upper)
+	var out string
+	if err := caller.Call("TestService.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "HELLO" {
+		t.Fatalf("bad: %q", out)
+	}
+	expected := []string{
+		"outer before TestService.Echo",
+		"inner before TestService.Echo",
+		"inner after TestService.Echo",
+		"outer after TestService.Echo",
+	}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("bad: %v", order)
+	}
+
+	if err := caller.Call("TestService.Fail", "boom", &out); err == nil {
+		t.Fatalf("expected error")
+	}
+	logged := buf.String()
+	if !strings.Contains(logged, "TestService.Echo took") || !strings.Contains(logged, "TestService.Fail failed after") {
+		t.Fatalf("bad: %q", logged)
+	}
+}
+
+func TestServeWithInterceptors(t *testing.T) {
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The response is sent before the interceptor sees the result, so the
+	// results are collected once all the calls are done.
+	type result struct {
+		method string
+		err    error
+	}
+	resultCh := make(chan result, 3)
+	record := func(next ServerHandler) ServerHandler {
+		return func(method string) error {
+			err := next(method)
+			resultCh <- result{method, err}
+			return err
+		}
+	}
+	deny := func(next ServerHandler) ServerHandler {
+		return func(method string) error {
+			if method == "TestService.Fail" {
+				return errors.New("permission denied")
+			}
+			return next(method)
+		}
+	}
+
+	clientConn, serverConn := net.Pipe()
+	go ServeWithInterceptors(serverConn, srv, record, deny)
+	cc := NewCodec(true, true, clientConn)
+	defer cc.Close()
+
+	var out string
+	if err := CallWithCodec(cc, "TestService.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+	err := CallWithCodec(cc, "TestService.Fail", "boom", &out)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "permission denied" {
+		t.Fatalf("bad: %v", err)
+	}
+	err = CallWithCodec(cc, "TestService.Missing", "boom", &out)
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.Fatalf("bad: %v", err)
+	}
+
+	results := make(map[string]error)
+	for i := 0; i < 3; i++ {
+		r := <-resultCh
+		results[r.method] = r.err
+	}
+	if results["TestService.Echo"] != nil {
+		t.Fatalf("bad: %v", results["TestService.Echo"])
+	}
+	if err := results["TestService.Fail"]; err == nil || err.Error() != "permission denied" {
+		t.Fatalf("bad: %v", err)
+	}
+	if err, ok := results["TestService.Missing"].(rpc.ServerError); !ok || !strings.Contains(err.Error(), "can't find") {
+		t.Fatalf("bad: %v", results["TestService.Missing"])
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+)
+
+// Response metadata lets a server attach key/value pairs to a response,
+// such as a remaining rate limit or the server's version, which the client
+// can read after the body with ReadResponseMetadata.
+//
+// A response with metadata has an extra Metadata field set to true in its
+// header, and the metadata is written as a map after the body. A response
+// without metadata is written exactly as by WriteResponse, so clients that
+// don't know about metadata are unaffected until a server actually sends
+// some. Those clients ignore the extra header field, but aren't expecting
+// the map after the body, so a server must only send metadata to clients
+// that can read it.
+//
+// A request can carry a request ID, such as a trace ID, in the same way. A
+// request with an ID has an extra RequestID field set to true in its header,
+// and the ID is written as a string before the body. A server built from
+// this release or later reads the ID before the body whether or not it asks
+// for it with ReadRequestID, so its handlers don't need to change. A server
+// built from an earlier release would decode the ID in place of the body, so
+// it must be upgraded before clients send request IDs to it.
+//
+// Requests can carry metadata too, such as the caller's deadline sent by
+// CallWithCodecDeadline. A request with metadata has an extra Metadata field
+// set to true in its header, and the metadata is written as a map before the
+// body, after the request ID if there is one. Like the ID, it is always read
+// by an upgraded server, which can get it with ReadRequestMetadata, and the
+// server must be upgraded before clients send it.
+
+// requestHeader is an rpc.Request with the flags marking that a request ID
+// or metadata come before the body.
+type requestHeader struct {
+	ServiceMethod string
+	Seq           uint64
+	RequestID     bool
+	Metadata      bool
+}
+
+// responseHeader is an rpc.Response with the flag marking that metadata
+// follows the body.
+type responseHeader struct {
+	ServiceMethod string
+	Seq           uint64
+	Error         string
+	Metadata      bool
+	Progress      bool
+}
+
+// WriteResponseWithMetadata writes a response like WriteResponse, followed
+// by the metadata md. If md is empty, the response is written exactly as by
+// WriteResponse.
+func (cc *MsgpackCodec) WriteResponseWithMetadata(r *rpc.Response, md map[string]string, body interface{}) error {
+	if len(md) == 0 {
+		return cc.WriteResponse(r, body)
+	}
+	header := responseHeader{
+		ServiceMethod: r.ServiceMethod,
+		Seq:           r.Seq,
+		Error:         r.Error,
+		Metadata:      true,
+	}
+	return cc.writeResponse(r, &header, body, md)
+}
+
+// ReadResponseMetadata returns the metadata sent with the last response. It
+// must be called after the response body has been read, and returns nil if
+// the server didn't send any.
+func (cc *MsgpackCodec) ReadResponseMetadata() map[string]string {
+	return cc.metadata
+}
+
+// readResponseBody reads the response body into out, and then the metadata
+// if the header said that it follows.
+func (cc *MsgpackCodec) readResponseBody(out interface{}) error {
+	if cc.slowThreshold > 0 {
+		defer cc.logIfSlow("read response body", cc.headerMethod, cc.headerSeq, time.Now())
+	}
+	if !cc.hasMetadata {
+		return cc.readAt(readBody, readHeader, out)
+	}
+	cc.hasMetadata = false
+	return cc.readAt(readBody, readHeader, out, &cc.metadata)
+}
+
+// CallWithRequestID is the same as CallWithCodec, but also sends requestID
+// with the request, for the server to read with ReadRequestID. If requestID
+// is empty, the request is sent without one. The codec must be a
+// MsgpackCodec, and the server must be built from a release of this package
+// that reads request IDs, even if it doesn't use them.
+func CallWithRequestID(cc rpc.ClientCodec, method, requestID string, args, resp interface{}) error {
+	if requestID == "" {
+		return CallWithCodec(cc, method, args, resp)
+	}
+	w, ok := cc.(interface {
+		writeRequestWithID(r *rpc.Request, id string, body interface{}) error
+	})
+	if !ok {
+		return errors.New("msgpackrpc: codec does not support request IDs")
+	}
+	request := rpc.Request{
+		Seq:           atomic.AddUint64(&nextCallSeq, 1),
+		ServiceMethod: method,
+	}
+	if err := w.writeRequestWithID(&request, requestID, args); err != nil {
+		return err
+	}
+	return readResponse(nil, cc, &request, resp)
+}
+
+// writeRequestWithID writes a request like WriteRequest, with the request
+// ID id before the body.
+func (cc *MsgpackCodec) writeRequestWithID(r *rpc.Request, id string, body interface{}) error {
+	if err := cc.validateMethod(r.ServiceMethod); err != nil {
+		return err
+	}
+	header := requestHeader{
+		ServiceMethod: r.ServiceMethod,
+		Seq:           r.Seq,
+		RequestID:     true,
+	}
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	body, err := cc.encodeBody(body)
+	if err != nil {
+		return err
+	}
+	if err := cc.write(&header, id, body); err != nil {
+		cc.closeConn()
+		return err
+	}
+	return nil
+}
+
+// ReadRequestID returns the request ID sent with the request whose header
+// was last read, or an empty string if it didn't have one. It must be
+// called after ReadRequestHeader and before the body is read.
+func (cc *MsgpackCodec) ReadRequestID() (string, error) {
+	if err := cc.readAt(readBody, readBody); err != nil {
+		return "", err
+	}
+	return cc.requestID, nil
+}
+
+// ReadRequestMetadata returns the metadata sent with the request whose
+// header was last read, or nil if it didn't have any. It must be called
+// after ReadRequestHeader and before the body is read.
+func (cc *MsgpackCodec) ReadRequestMetadata() (map[string]string, error) {
+	if err := cc.readAt(readBody, readBody); err != nil {
+		return nil, err
+	}
+	return cc.reqMetadata, nil
+}
+
+// writeRequestWithMetadata writes a request like WriteRequest, with the
+// metadata md before the body.
+func (cc *MsgpackCodec) writeRequestWithMetadata(r *rpc.Request, md map[string]string, body interface{}) error {
+	if err := cc.validateMethod(r.ServiceMethod); err != nil {
+		return err
+	}
+	header := requestHeader{
+		ServiceMethod: r.ServiceMethod,
+		Seq:           r.Seq,
+		Metadata:      true,
+	}
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	body, err := cc.encodeBody(body)
+	if err != nil {
+		return err
+	}
+	if err := cc.write(&header, md, body); err != nil {
+		cc.closeConn()
+		return err
+	}
+	return nil
+}
+
+// MetadataTimeout is the request metadata key holding the time remaining
+// until the caller's deadline, sent by CallWithCodecDeadline. It is
+// formatted as a time.Duration string.
+const MetadataTimeout = "msgpackrpc-timeout"
+
+// CallWithCodecContext is the same as CallWithCodec, but aborts the call if
+// ctx is done before it completes, closing the codec and returning the
+// context's error. The request is written exactly as by CallWithCodec, so
+// any server can handle it. Use CallWithCodecDeadline to also send the
+// caller's deadline to the server.
+func CallWithCodecContext(ctx context.Context, cc rpc.ClientCodec, method string, args, resp interface{}) error {
+	return callWithContext(ctx, cc, method, args, resp, false)
+}
+
+// CallWithCodecDeadline is the same as CallWithCodecContext, but if ctx has
+// a deadline and the codec is a MsgpackCodec, the time remaining until it is
+// sent in the request metadata, so the server can get a deadline of its own
+// with DeadlineFromMetadata and abandon work the caller will no longer wait
+// for. Request metadata changes how the request is framed, so the server
+// must be built from a release of this package that reads it, such as one
+// served by ServeConnCtx.
+//
+// The remaining time is sent rather than the deadline itself so that clock
+// skew between the client and server doesn't matter. The server's deadline
+// is later than the client's by the time the request spends in transit,
+// which is a safe direction to err in. The server may still give up first
+// and send back an error, so if ctx is done or its deadline has passed by
+// the time the call returns, the context's error is returned instead of the
+// server's.
+func CallWithCodecDeadline(ctx context.Context, cc rpc.ClientCodec, method string, args, resp interface{}) error {
+	return callWithContext(ctx, cc, method, args, resp, true)
+}
+
+// callWithContext makes a call that is aborted when ctx is done, sending
+// the remaining time until its deadline in the request metadata if
+// sendDeadline is set. An error from a call that outlived ctx is replaced
+// with the context's error.
+func callWithContext(ctx context.Context, cc rpc.ClientCodec, method string, args, resp interface{}, sendDeadline bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := callWithContextOnce(ctx, cc, method, args, resp, sendDeadline)
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	// The context's timer may not have fired yet even though its deadline
+	// has passed.
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+func callWithContextOnce(ctx context.Context, cc rpc.ClientCodec, method string, args, resp interface{}, sendDeadline bool) error {
+	if rc, ok := cc.(*RateLimitedCodec); ok {
+		// Wait with ctx, so the call can be abandoned while it's held
+		// back, and then write to the codec directly.
+		if err := rc.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		cc = rc.cc
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	w, ok := cc.(interface {
+		writeRequestWithMetadata(r *rpc.Request, md map[string]string, body interface{}) error
+	})
+	if !sendDeadline || !hasDeadline || !ok {
+		return callWithDone(ctx.Done(), ctx.Err, cc, method, args, resp)
+	}
+	return abortOnDone(ctx.Done(), ctx.Err, cc, func() error {
+		request := rpc.Request{
+			Seq:           atomic.AddUint64(&nextCallSeq, 1),
+			ServiceMethod: method,
+		}
+		md := map[string]string{
+			MetadataTimeout: time.Until(deadline).String(),
+		}
+		if err := w.writeRequestWithMetadata(&request, md, args); err != nil {
+			return err
+		}
+		return readResponse(nil, cc, &request, resp)
+	})
+}
+
+// DeadlineFromMetadata returns the deadline sent in request metadata by
+// CallWithCodecDeadline, relative to now, and whether there was one.
+func DeadlineFromMetadata(md map[string]string) (time.Time, bool) {
+	timeout, ok := md[MetadataTimeout]
+	if !ok {
+		return time.Time{}, false
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Now().Add(d), true
+}
@@ -0,0 +1,349 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+func TestCodec_ResponseMetadata(t *testing.T) {
+	conn := &bufConn{}
+	server := NewCodec(true, true, conn)
+	md := map[string]string{"version": "1.2.3", "remaining": "10"}
+	resp := rpc.Response{ServiceMethod: "Test.Echo", Seq: 1}
+	if err := server.WriteResponseWithMetadata(&resp, md, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Seq = 2
+	if err := server.WriteResponseWithMetadata(&resp, md, "skipped"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Seq = 3
+	if err := server.WriteResponse(&resp, "world"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client := NewCodec(true, true, &bufConn{r: &conn.w})
+	var header rpc.Response
+	if err := client.ReadResponseHeader(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out string
+	if err := client.ReadResponseBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header.Seq != 1 || out != "hello" {
+		t.Fatalf("bad: %#v %q", header, out)
+	}
+	if got := client.ReadResponseMetadata(); !reflect.DeepEqual(got, md) {
+		t.Fatalf("bad: %#v", got)
+	}
+
+	// Skipping the body also skips the metadata.
+	if err := client.ReadResponseHeader(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.SkipResponseBody(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A response without metadata leaves none behind.
+	if err := client.ReadResponseHeader(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.ReadResponseBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header.Seq != 3 || out != "world" {
+		t.Fatalf("bad: %#v %q", header, out)
+	}
+	if got := client.ReadResponseMetadata(); got != nil {
+		t.Fatalf("bad: %#v", got)
+	}
+}
+
+func TestCodec_ResponseMetadata_Interop(t *testing.T) {
+	// Without metadata, the response is written exactly as before, so
+	// clients that don't know about metadata can read it.
+	var plain, empty bufConn
+	resp := rpc.Response{ServiceMethod: "Test.Echo", Seq: 1}
+	if err := NewCodec(false, false, &plain).WriteResponse(&resp, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := NewCodec(false, false, &empty).WriteResponseWithMetadata(&resp, nil, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(plain.w.Bytes(), empty.w.Bytes()) {
+		t.Fatalf("bad: %v %v", plain.w.Bytes(), empty.w.Bytes())
+	}
+
+	// A response written by a server that doesn't know about metadata has
+	// none, and a response with metadata has a header that an older client
+	// can still decode.
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf, msgpackHandle)
+	if err := enc.Encode(&resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := enc.Encode("hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client := NewCodec(false, false, &bufConn{r: &buf})
+	var out string
+	if err := CallWithCodec(client, "Test.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if md := client.ReadResponseMetadata(); md != nil {
+		t.Fatalf("bad: %#v", md)
+	}
+
+	var withMD bufConn
+	err := NewCodec(false, false, &withMD).WriteResponseWithMetadata(&resp, map[string]string{"a": "b"}, "hello")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var header rpc.Response
+	if err := codec.NewDecoder(&withMD.w, msgpackHandle).Decode(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header != resp {
+		t.Fatalf("bad: %#v", header)
+	}
+}
+
+func TestCallWithRequestID(t *testing.T) {
+	// A server that doesn't read the ID still handles the call.
+	cc := testServer(t)
+	var out string
+	if err := CallWithRequestID(cc, "TestService.Echo", "trace-1", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// One that does reads it before the body.
+	conn := &bufConn{}
+	client := NewCodec(false, false, conn)
+	if err := client.writeRequestWithID(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 1}, "trace-1", "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 2}, "world"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	server := NewCodec(false, false, &bufConn{r: &conn.w})
+	var req rpc.Request
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id, err := server.ReadRequestID()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id != "trace-1" {
+		t.Fatalf("bad: %q", id)
+	}
+	var body string
+	if err := server.ReadRequestBody(&body); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Seq != 1 || body != "hello" {
+		t.Fatalf("bad: %#v %q", req, body)
+	}
+
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id, err := server.ReadRequestID(); err != nil || id != "" {
+		t.Fatalf("bad: %q %v", id, err)
+	}
+	if err := server.ReadRequestBody(&body); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Seq != 2 || body != "world" {
+		t.Fatalf("bad: %#v %q", req, body)
+	}
+}
+
+func TestCallWithRequestID_UnencodableBody(t *testing.T) {
+	conn := &bufConn{}
+	cc := NewCodec(true, true, conn)
+
+	// The request isn't written at all, and the codec stays usable.
+	if err := cc.writeRequestWithID(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 1}, "trace-1", complex(1, 2)); err == nil {
+		t.Fatalf("expected error")
+	}
+	if conn.w.Len() != 0 {
+		t.Fatalf("bad: %d bytes written", conn.w.Len())
+	}
+	if cc.IsClosed() {
+		t.Fatalf("expected codec to be open")
+	}
+	if err := cc.writeRequestWithID(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 2}, "trace-2", "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	server := NewCodec(false, false, &bufConn{r: &conn.w})
+	var req rpc.Request
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	id, err := server.ReadRequestID()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Seq != 2 || id != "trace-2" {
+		t.Fatalf("bad: %v %q", req, id)
+	}
+}
+
+func TestReadRequestMetadata(t *testing.T) {
+	conn := &bufConn{}
+	client := NewCodec(true, true, conn)
+	md := map[string]string{"a": "b"}
+	if err := client.writeRequestWithMetadata(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 1}, md, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.WriteRequest(&rpc.Request{ServiceMethod: "Test.Echo", Seq: 2}, "world"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	server := NewCodec(true, true, &bufConn{r: &conn.w})
+	var req rpc.Request
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	got, err := server.ReadRequestMetadata()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(got, md) {
+		t.Fatalf("bad: %v", got)
+	}
+	var out string
+	if err := server.ReadRequestBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// Metadata is skipped if not asked for, and absent for a plain request.
+	if err := server.ReadRequestHeader(&req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, err := server.ReadRequestMetadata(); err != nil || got != nil {
+		t.Fatalf("bad: %v %v", got, err)
+	}
+	if err := server.ReadRequestBody(&out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "world" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestCallWithCodecContext(t *testing.T) {
+	abandoned := make(chan error, 1)
+	handler := func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error) {
+		switch method {
+		case "Test.Deadline":
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				return time.Duration(0), nil
+			}
+			return time.Until(deadline), nil
+		case "Test.Slow":
+			<-ctx.Done()
+			abandoned <- ctx.Err()
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+	clientConn, serverConn := net.Pipe()
+	go ServeConnCtx(serverConn, handler)
+	cc := NewCodec(true, true, clientConn)
+	defer cc.Close()
+
+	// The caller's deadline isn't sent unless asked for.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var remaining time.Duration
+	if err := CallWithCodecContext(ctx, cc, "Test.Deadline", nil, &remaining); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if remaining != 0 {
+		t.Fatalf("bad: %v", remaining)
+	}
+
+	// With CallWithCodecDeadline, the server's context gets it.
+	if err := CallWithCodecDeadline(ctx, cc, "Test.Deadline", nil, &remaining); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if remaining <= 0 || remaining > time.Minute {
+		t.Fatalf("bad: %v", remaining)
+	}
+	if err := CallWithCodecDeadline(context.Background(), cc, "Test.Deadline", nil, &remaining); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if remaining != 0 {
+		t.Fatalf("bad: %v", remaining)
+	}
+
+	// When the deadline passes, the server abandons the work and the call
+	// is aborted. Either side may give up first, but the caller always sees
+	// its own context's error rather than the server's.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := CallWithCodecDeadline(ctx, cc, "Test.Slow", nil, nil); err != context.DeadlineExceeded {
+		t.Fatalf("bad: %v", err)
+	}
+	select {
+	case err := <-abandoned:
+		if err != context.DeadlineExceeded && err != context.Canceled {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected server to abandon the call")
+	}
+}
+
+func TestDeadlineFromMetadata(t *testing.T) {
+	if _, ok := DeadlineFromMetadata(nil); ok {
+		t.Fatalf("expected no deadline")
+	}
+	if _, ok := DeadlineFromMetadata(map[string]string{MetadataTimeout: "soon"}); ok {
+		t.Fatalf("expected no deadline")
+	}
+	before := time.Now()
+	deadline, ok := DeadlineFromMetadata(map[string]string{MetadataTimeout: "1.5s"})
+	if !ok || deadline.Before(before.Add(1500*time.Millisecond)) || deadline.After(time.Now().Add(1500*time.Millisecond)) {
+		t.Fatalf("bad: %v %v", deadline, ok)
+	}
+}
+
+func TestCallWithCodecContext_PlainServer(t *testing.T) {
+	// A request with a deadline is framed as by CallWithCodec, so a server
+	// that doesn't read request metadata can handle it.
+	cc := testServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var resp string
+	if err := CallWithCodecContext(ctx, cc, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+}
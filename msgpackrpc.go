@@ -4,23 +4,151 @@
 // Package msgpackrpc implements a MessagePack-RPC ClientCodec and ServerCodec
 // for the rpc package, using the same API as the Go standard library
 // for jsonrpc.
+//
+// # Durations and other integer types
+//
+// A time.Duration, like any named integer type, is encoded as a msgpack
+// integer holding its underlying value, which for a Duration is a count of
+// nanoseconds. It decodes correctly into a Duration from any integer that
+// fits in an int64, whether the peer wrote it as signed or unsigned, so
+// peers in other languages should send durations as integer nanoseconds.
+// Floats and strings such as "5s" are rejected with a decode error rather
+// than converted. Decoding into an interface{} loses the named type, giving
+// an int64 or uint64, so durations should be decoded into a field of type
+// time.Duration.
 package msgpackrpc
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Dial connects to a MessagePack-RPC server at the specified network address.
 func Dial(network, address string) (*rpc.Client, error) {
-	conn, err := net.Dial(network, address)
+	return DialWithDialer(&net.Dialer{}, network, address)
+}
+
+// DialWithDialer connects to a MessagePack-RPC server at the specified network
+// address using the given dialer. This allows control over settings such as
+// the local address, keepalive period and socket options.
+func DialWithDialer(d *net.Dialer, network, address string) (*rpc.Client, error) {
+	conn, err := d.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
 	return NewClient(conn), err
 }
 
+// DialKeepAlive connects to a MessagePack-RPC server at the specified
+// network address with TCP keepalive enabled, using period as the dialer's
+// KeepAlive setting. This lets a long-lived connection detect a dead peer
+// rather than block forever on a read.
+func DialKeepAlive(network, address string, period time.Duration) (*rpc.Client, error) {
+	return DialWithDialer(keepAliveDialer(period), network, address)
+}
+
+// keepAliveDialer returns a dialer that enables TCP keepalive with the given
+// period.
+func keepAliveDialer(period time.Duration) *net.Dialer {
+	return &net.Dialer{KeepAlive: period}
+}
+
+// DialUnix connects to a MessagePack-RPC server listening on the unix
+// domain socket at path.
+func DialUnix(path string) (*rpc.Client, error) {
+	return Dial("unix", path)
+}
+
+// ListenUnix listens on a unix domain socket at path, for serving local
+// clients with Serve. If a socket file is left at path by a server that
+// is no longer running, it is removed first, but an error is returned if
+// another server is still listening on it or the path is some other kind of
+// file. The socket's permissions are set to 0600, so that only the owner
+// can connect, and it is removed when the listener is closed.
+//
+// The socket is created in a private directory next to path and linked into
+// place once its permissions are set, so no other user can connect to it in
+// between. This needs a hard link, so path's directory must be writable and
+// on a filesystem that supports them.
+func ListenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".msgpackrpc")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The temporary name is removed along with dir, so only path needs to
+	// be removed on close.
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Link(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener is a listener from ListenUnix, which reports path as its
+// address and removes it when closed.
+type unixListener struct {
+	*net.UnixListener
+	path      string
+	closeOnce sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.closeOnce.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// removeStaleSocket removes the socket file at path if nothing is listening
+// on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("msgpackrpc: %s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("msgpackrpc: %s is in use by another server", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
 // NewClient returns a new rpc.Client to handle requests to the set of
 // services at the other end of the connection.
 func NewClient(conn io.ReadWriteCloser) *rpc.Client {
@@ -43,3 +171,25 @@ func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
 func ServeConn(conn io.ReadWriteCloser) {
 	rpc.ServeCodec(NewServerCodec(conn))
 }
+
+// ServeConnWithServer is the same as ServeConn, but serves the services
+// registered on srv rather than rpc.DefaultServer.
+func ServeConnWithServer(srv *rpc.Server, conn io.ReadWriteCloser) {
+	srv.ServeCodec(NewServerCodec(conn))
+}
+
+// ServeNew creates a new rpc.Server, registers each of the receivers on it,
+// and serves conn with it like ServeConnWithServer. If any receiver fails to
+// register, the connection is closed without being served and the error is
+// returned.
+func ServeNew(conn io.ReadWriteCloser, receivers ...interface{}) error {
+	srv := rpc.NewServer()
+	for _, rcvr := range receivers {
+		if err := srv.Register(rcvr); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	ServeConnWithServer(srv, conn)
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := keepAliveDialer(7*time.Second).Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var keepAlive, idle int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		keepAlive, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if sockErr != nil {
+			return
+		}
+		idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sockErr != nil {
+		t.Fatalf("err: %v", sockErr)
+	}
+	if keepAlive == 0 {
+		t.Fatalf("expected keepalive to be enabled")
+	}
+	if idle != 7 {
+		t.Fatalf("bad: %d", idle)
+	}
+}
+
+func TestDialKeepAlive(t *testing.T) {
+	registerDefault(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+		ServeConn(conn)
+	}()
+
+	client, err := DialKeepAlive("tcp", l.Addr().String(), 7*time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	var resp string
+	if err := client.Call("TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serverConn, ok := <-accepted
+	if !ok {
+		t.Fatalf("expected a connection")
+	}
+
+	// The client's socket isn't reachable through the rpc.Client, so find
+	// it in /proc/net/tcp by its local port. A keepalive timer shows up as
+	// timer type 2, with the time until it fires in hundredths of a second.
+	port := serverConn.RemoteAddr().(*net.TCPAddr).Port
+	local := fmt.Sprintf("0100007F:%04X", port)
+	table, err := os.ReadFile("/proc/net/tcp")
+	if err != nil {
+		t.Skipf("can't read socket table: %v", err)
+	}
+	for _, line := range strings.Split(string(table), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[1] != local {
+			continue
+		}
+		timer, when, _ := strings.Cut(fields[5], ":")
+		ticks, err := strconv.ParseUint(when, 16, 64)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if timer != "02" || ticks == 0 || ticks > 700 {
+			t.Fatalf("expected a keepalive timer within 7s: %s", fields[5])
+		}
+		return
+	}
+	t.Fatalf("socket %s not found", local)
+}
@@ -2,3 +2,230 @@
 // SPDX-License-Identifier: MIT
 
 package msgpackrpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bufConn is an io.ReadWriteCloser that reads from r and records all writes.
+type bufConn struct {
+	r      io.Reader
+	w      bytes.Buffer
+	closed bool
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *bufConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// TestService is a service registered by tests that need a real server.
+type TestService struct{}
+
+func (s *TestService) Echo(args string, resp *string) error {
+	*resp = args
+	return nil
+}
+
+func (s *TestService) Fail(args string, resp *string) error {
+	return errors.New(args)
+}
+
+// testServer returns a client codec connected over an in-memory pipe to an
+// rpc.Server serving TestService.
+func testServer(t *testing.T) *MsgpackCodec {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(NewServerCodec(serverConn))
+	return NewCodec(true, true, clientConn)
+}
+
+func TestNewClient_CodecServer(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(NewCodec(false, false, serverConn))
+
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	var resp string
+	if err := client.Call("TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+}
+
+// noMethods has no methods suitable for net/rpc, so it can't be registered.
+type noMethods struct{}
+
+func TestServeNew(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() { errCh <- ServeNew(serverConn, new(TestService), new(PanicService)) }()
+
+	client := NewClient(clientConn)
+	var resp string
+	if err := client.Call("TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+	client.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A receiver that can't be registered closes the connection unserved.
+	clientConn, serverConn = net.Pipe()
+	defer clientConn.Close()
+	if err := ServeNew(serverConn, new(TestService), new(noMethods)); err == nil {
+		t.Fatalf("expected error")
+	}
+	var buf [1]byte
+	if _, err := clientConn.Read(buf[:]); err != io.EOF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	l, err := ListenUnix(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("bad: %v", fi.Mode())
+	}
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ServeConnWithServer(srv, conn)
+		}
+	}()
+
+	client, err := DialUnix(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	var resp string
+	if err := client.Call("TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+
+	// A socket that is still being listened on isn't removed.
+	if _, err := ListenUnix(path); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestListenUnix_Cleanup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rpc.sock")
+	l, err := ListenUnix(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr := l.Addr().String(); addr != path {
+		t.Fatalf("bad: %q", addr)
+	}
+
+	// The private directory the socket was created in is gone.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "rpc.sock" {
+		t.Fatalf("bad: %v", entries)
+	}
+
+	// Closing the listener removes the socket.
+	if err := l.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := ListenUnix(filepath.Join(dir, "missing", "rpc.sock")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestListenUnix_Stale(t *testing.T) {
+	dir := t.TempDir()
+
+	// Leave a socket file behind with nothing listening on it.
+	path := filepath.Join(dir, "rpc.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = ListenUnix(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l.Close()
+
+	// Other files are left alone.
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := ListenUnix(file); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+// Package msgpackrpctest provides utilities for testing services that are
+// served using the msgpackrpc codec.
+package msgpackrpctest
+
+import (
+	"net"
+	"net/rpc"
+
+	"github.com/hashicorp/net-rpc-msgpackrpc/v2"
+)
+
+// NewPipe returns a client connected over an in-memory pipe to a new
+// rpc.Server, using the msgpackrpc codec on both ends. Services should be
+// registered on the returned server before making calls. The cleanup
+// function closes both ends of the connection.
+func NewPipe() (client *rpc.Client, server *rpc.Server, cleanup func()) {
+	clientConn, serverConn := net.Pipe()
+
+	server = rpc.NewServer()
+	go server.ServeCodec(msgpackrpc.NewServerCodec(serverConn))
+
+	client = msgpackrpc.NewClient(clientConn)
+	cleanup = func() {
+		client.Close()
+		serverConn.Close()
+	}
+	return client, server, cleanup
+}
+
+// Loopback starts a TCP listener on localhost that serves rcvr with the
+// msgpackrpc codec, and returns a client connected to it. Unlike NewPipe,
+// this goes through real sockets, which makes it suitable for realistic
+// benchmarks. The close function closes the client and the listener.
+func Loopback(rcvr interface{}) (client *rpc.Client, closeFn func(), err error) {
+	server := rpc.NewServer()
+	if err := server.Register(rcvr); err != nil {
+		return nil, nil, err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go msgpackrpc.ServeConnWithServer(server, conn)
+		}
+	}()
+
+	client, err = msgpackrpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+	closeFn = func() {
+		client.Close()
+		l.Close()
+	}
+	return client, closeFn, nil
+}
@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpctest
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+)
+
+type TestService struct{}
+
+func (s *TestService) Echo(args string, resp *string) error {
+	*resp = args
+	return nil
+}
+
+func (s *TestService) Fail(args string, resp *string) error {
+	return errors.New(args)
+}
+
+func TestNewPipe(t *testing.T) {
+	client, server, cleanup := NewPipe()
+	defer cleanup()
+	if err := server.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var resp string
+	if err := client.Call("TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+	err := client.Call("TestService.Fail", "boom", &resp)
+	if err != rpc.ServerError("boom") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// After cleanup, the client is shut down.
+	cleanup()
+	if err := client.Call("TestService.Echo", "hello", &resp); err != rpc.ErrShutdown {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	client, closeFn, err := Loopback(new(TestService))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer closeFn()
+
+	var resp string
+	if err := client.Call("TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+	err = client.Call("TestService.Fail", "boom", &resp)
+	if err != rpc.ServerError("boom") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// A receiver that can't be registered is reported.
+	if _, _, err := Loopback(struct{}{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
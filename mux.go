@@ -0,0 +1,164 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"net/rpc"
+	"sync"
+)
+
+// MuxClient makes concurrent calls over a single codec, matching each
+// response to its call by sequence number, so the server may respond in any
+// order. This is what rpc.Client does too; MuxClient differs in how results
+// are delivered. Go returns a PendingCall whose Done channel receives just
+// the call's error, which is convenient to select on alongside other
+// channels. It is safe for concurrent use.
+type MuxClient struct {
+	cc rpc.ClientCodec
+
+	// writeLock serializes writing requests to the codec.
+	writeLock sync.Mutex
+
+	lock     sync.Mutex
+	seq      uint64
+	pending  map[uint64]*PendingCall
+	shutdown bool
+}
+
+// PendingCall is a call made with MuxClient.Go that may not have completed
+// yet.
+type PendingCall struct {
+	// Method and Resp are the method called and the object its response is
+	// decoded into.
+	Method string
+	Resp   interface{}
+
+	done chan error
+}
+
+// Done returns a channel that receives the result of the call once it has
+// completed: nil on success, or the error it failed with. It receives
+// exactly one value.
+func (p *PendingCall) Done() <-chan error {
+	return p.done
+}
+
+func (p *PendingCall) finish(err error) {
+	p.done <- err
+}
+
+// NewMuxClient returns a MuxClient that makes calls over cc, and starts
+// reading responses from it. It takes ownership of cc, which must not be
+// used for anything else.
+func NewMuxClient(cc rpc.ClientCodec) *MuxClient {
+	m := &MuxClient{
+		cc:      cc,
+		pending: make(map[uint64]*PendingCall),
+	}
+	go m.readLoop()
+	return m
+}
+
+// Go starts a call to method, returning a PendingCall that reports when it
+// has completed. The response is decoded into resp.
+func (m *MuxClient) Go(method string, args, resp interface{}) *PendingCall {
+	call := &PendingCall{
+		Method: method,
+		Resp:   resp,
+		done:   make(chan error, 1),
+	}
+
+	m.lock.Lock()
+	if m.shutdown {
+		m.lock.Unlock()
+		call.finish(rpc.ErrShutdown)
+		return call
+	}
+	m.seq++
+	seq := m.seq
+	m.pending[seq] = call
+	m.lock.Unlock()
+
+	request := rpc.Request{
+		ServiceMethod: method,
+		Seq:           seq,
+	}
+	m.writeLock.Lock()
+	err := m.cc.WriteRequest(&request, args)
+	m.writeLock.Unlock()
+	if err != nil {
+		// The read loop may have already failed the call if the codec was
+		// closed.
+		if call := m.take(seq); call != nil {
+			call.finish(err)
+		}
+	}
+	return call
+}
+
+// Call makes a call to method and waits for it to complete.
+func (m *MuxClient) Call(method string, args, resp interface{}) error {
+	return <-m.Go(method, args, resp).Done()
+}
+
+// Close closes the codec. Calls that are still waiting for a response fail
+// with rpc.ErrShutdown.
+func (m *MuxClient) Close() error {
+	m.lock.Lock()
+	if m.shutdown {
+		m.lock.Unlock()
+		return rpc.ErrShutdown
+	}
+	m.shutdown = true
+	m.lock.Unlock()
+	return m.cc.Close()
+}
+
+// take removes and returns the pending call with the given sequence
+// number, or nil if there is none.
+func (m *MuxClient) take(seq uint64) *PendingCall {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	call := m.pending[seq]
+	delete(m.pending, seq)
+	return call
+}
+
+// readLoop reads responses and completes their calls until reading fails,
+// and then fails any calls still waiting.
+func (m *MuxClient) readLoop() {
+	var err error
+	for err == nil {
+		var response rpc.Response
+		if err = m.cc.ReadResponseHeader(&response); err != nil {
+			break
+		}
+		call := m.take(response.Seq)
+		switch {
+		case call == nil:
+			// The call failed to write or is otherwise unknown, so the
+			// body is discarded.
+			err = m.cc.ReadResponseBody(nil)
+		case response.Error != "":
+			err = m.cc.ReadResponseBody(nil)
+			call.finish(rpc.ServerError(response.Error))
+		default:
+			err = m.cc.ReadResponseBody(call.Resp)
+			call.finish(err)
+		}
+	}
+
+	m.lock.Lock()
+	if m.shutdown {
+		err = rpc.ErrShutdown
+	}
+	m.shutdown = true
+	pending := m.pending
+	m.pending = make(map[uint64]*PendingCall)
+	m.lock.Unlock()
+	m.cc.Close()
+	for _, call := range pending {
+		call.finish(err)
+	}
+}
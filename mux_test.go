@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestMuxClient(t *testing.T) {
+	// The server sleeps for the requested time before responding, so
+	// responses arrive out of order.
+	release := make(chan struct{})
+	handler := func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error) {
+		var delay time.Duration
+		if err := dec(&delay); err != nil {
+			return nil, err
+		}
+		switch method {
+		case "Test.Sleep":
+			time.Sleep(delay)
+			return delay, nil
+		case "Test.Fail":
+			return nil, errors.New("boom")
+		case "Test.Block":
+			<-release
+			return nil, nil
+		}
+		return nil, errors.New("unknown method")
+	}
+	clientConn, serverConn := net.Pipe()
+	defer close(release)
+	go ServeConnCtx(serverConn, handler)
+	m := NewMuxClient(NewCodec(true, true, clientConn))
+
+	delays := []time.Duration{150 * time.Millisecond, 75 * time.Millisecond, 0}
+	resps := make([]time.Duration, len(delays))
+	calls := make([]*PendingCall, len(delays))
+	for i, delay := range delays {
+		calls[i] = m.Go("Test.Sleep", delay, &resps[i])
+	}
+
+	// The calls complete in the reverse order to how they were made.
+	for i := len(calls) - 1; i >= 0; i-- {
+		select {
+		case err := <-calls[i].Done():
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("call %d didn't complete", i)
+		}
+		for j := 0; j < i; j++ {
+			select {
+			case <-calls[j].Done():
+				t.Fatalf("call %d completed before call %d", j, i)
+			default:
+			}
+		}
+	}
+	for i, delay := range delays {
+		if resps[i] != delay {
+			t.Fatalf("bad: %d %v", i, resps[i])
+		}
+	}
+
+	err := m.Call("Test.Fail", time.Duration(0), nil)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "boom" {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Closing the client fails calls still waiting for a response, and
+	// any made afterwards.
+	blocked := m.Go("Test.Block", time.Duration(0), nil)
+	time.Sleep(10 * time.Millisecond)
+	if err := m.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-blocked.Done():
+		if err != rpc.ErrShutdown {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected call to fail")
+	}
+	if err := m.Call("Test.Sleep", time.Duration(0), nil); err != rpc.ErrShutdown {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"io"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// Option configures a codec created with New.
+type Option func(*Config)
+
+// New returns a MsgpackCodec for conn configured by opts. Reads and writes
+// are buffered unless disabled with WithBufferedReads or WithBufferedWrites.
+// Options not covered by an Option can be set with NewCodecFromConfig.
+func New(conn io.ReadWriteCloser, opts ...Option) *MsgpackCodec {
+	conf := Config{
+		BufferedReads:  true,
+		BufferedWrites: true,
+	}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	return NewCodecFromConfig(conn, &conf)
+}
+
+// WithBufferedReads sets whether reads from the connection are buffered.
+func WithBufferedReads(buffered bool) Option {
+	return func(c *Config) {
+		c.BufferedReads = buffered
+	}
+}
+
+// WithBufferedWrites sets whether writes to the connection are buffered.
+func WithBufferedWrites(buffered bool) Option {
+	return func(c *Config) {
+		c.BufferedWrites = buffered
+	}
+}
+
+// WithHandle sets the msgpack handle used for encoding and decoding.
+func WithHandle(h *codec.MsgpackHandle) Option {
+	return func(c *Config) {
+		c.Handle = h
+	}
+}
+
+// WithReadBufferSize sets the size of the read buffer.
+func WithReadBufferSize(size int) Option {
+	return func(c *Config) {
+		c.ReadBufferSize = size
+	}
+}
+
+// WithWriteBufferSize sets the size of the write buffer.
+func WithWriteBufferSize(size int) Option {
+	return func(c *Config) {
+		c.WriteBufferSize = size
+	}
+}
+
+// WithLogger sets the logger used to log errors that close the codec.
+func WithLogger(logger Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// WithFlushInterval sets the interval at which buffered writes are flushed
+// in the background. See Config.FlushInterval.
+func WithFlushInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.FlushInterval = d
+	}
+}
+
+// WithMaxMethodLen limits the length of method names in request headers.
+// See Config.MaxMethodLen.
+func WithMaxMethodLen(n int) Option {
+	return func(c *Config) {
+		c.MaxMethodLen = n
+	}
+}
+
+// WithResetEncoderAfter reinitializes the encoder every n messages written
+// to release memory. See Config.ResetEncoderAfter.
+func WithResetEncoderAfter(n int) Option {
+	return func(c *Config) {
+		c.ResetEncoderAfter = n
+	}
+}
+
+// WithSlowThreshold logs operations that take longer than d with the
+// codec's logger. See Config.SlowThreshold.
+func WithSlowThreshold(d time.Duration) Option {
+	return func(c *Config) {
+		c.SlowThreshold = d
+	}
+}
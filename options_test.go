@@ -0,0 +1,35 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	cc := New(&bufConn{})
+	if reads, writes := cc.IsBuffered(); !reads || !writes {
+		t.Fatalf("bad: %v %v", reads, writes)
+	}
+	if cc.h != msgpackHandle {
+		t.Fatalf("expected the default handle")
+	}
+
+	h := DefaultHandle()
+	cc = New(&bufConn{},
+		WithBufferedReads(false),
+		WithBufferedWrites(false),
+		WithHandle(h))
+	if reads, writes := cc.IsBuffered(); reads || writes {
+		t.Fatalf("bad: %v %v", reads, writes)
+	}
+	if cc.h != h {
+		t.Fatalf("expected the given handle")
+	}
+
+	cc = New(&bufConn{}, WithReadBufferSize(64*1024), WithWriteBufferSize(32*1024))
+	if cc.bufR.Size() != 64*1024 || cc.bufW.Size() != 32*1024 {
+		t.Fatalf("bad: %d %d", cc.bufR.Size(), cc.bufW.Size())
+	}
+}
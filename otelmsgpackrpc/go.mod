@@ -0,0 +1,25 @@
+module github.com/hashicorp/net-rpc-msgpackrpc/v2/otelmsgpackrpc
+
+go 1.20
+
+require (
+	github.com/hashicorp/net-rpc-msgpackrpc/v2 v2.0.1-0.20261016012650-2ff3c640b074
+	go.opentelemetry.io/otel v1.21.0
+	go.opentelemetry.io/otel/sdk v1.21.0
+	go.opentelemetry.io/otel/trace v1.21.0
+)
+
+require (
+	github.com/go-logr/logr v1.3.0 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-msgpack/v2 v2.1.1 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	go.opentelemetry.io/otel/metric v1.21.0 // indirect
+	golang.org/x/sys v0.14.0 // indirect
+)
+
+// The requirement above is the first version with CallWithCodecSized. The
+// replace directive only builds against the parent module for local
+// development, and is ignored by modules that depend on this one.
+replace github.com/hashicorp/net-rpc-msgpackrpc/v2 => ../
@@ -0,0 +1,52 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+// Package otelmsgpackrpc provides OpenTelemetry tracing for MessagePack-RPC
+// calls. It is a separate module so that the core msgpackrpc package does not
+// depend on OpenTelemetry.
+package otelmsgpackrpc
+
+import (
+	"context"
+	"net/rpc"
+	"strings"
+
+	"github.com/hashicorp/net-rpc-msgpackrpc/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CallWithCodecTraced performs msgpackrpc.CallWithCodec inside a client span
+// named after the method. Errors are recorded on the span, along with the
+// number of bytes the request and response took on the wire, headers
+// included. The sizes are only known for a msgpackrpc.MsgpackCodec.
+func CallWithCodecTraced(ctx context.Context, tracer trace.Tracer, cc rpc.ClientCodec,
+	method string, args, resp interface{}) error {
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.system", "msgpackrpc"),
+	}
+	if service, name, ok := strings.Cut(method, "."); ok {
+		attrs = append(attrs,
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", name))
+	}
+	_, span := tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	defer span.End()
+
+	reqBytes, respBytes, err := msgpackrpc.CallWithCodecSized(cc, method, args, resp)
+	if reqBytes > 0 {
+		span.SetAttributes(attribute.Int("rpc.request.size", reqBytes))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	if respBytes > 0 {
+		span.SetAttributes(attribute.Int("rpc.response.size", respBytes))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package otelmsgpackrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"github.com/hashicorp/net-rpc-msgpackrpc/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type TestService struct{}
+
+func (s *TestService) Echo(args string, resp *string) error {
+	*resp = args
+	return nil
+}
+
+func (s *TestService) Fail(args string, resp *string) error {
+	return errors.New("failed")
+}
+
+func testServer(t *testing.T) *msgpackrpc.MsgpackCodec {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	srv := rpc.NewServer()
+	if err := srv.Register(new(TestService)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go srv.ServeCodec(msgpackrpc.NewServerCodec(serverConn))
+	return msgpackrpc.NewCodec(true, true, clientConn)
+}
+
+func testTracer(t *testing.T) (trace.Tracer, *tracetest.SpanRecorder) {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+	})
+	return provider.Tracer("otelmsgpackrpc_test"), recorder
+}
+
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestCallWithCodecTraced(t *testing.T) {
+	cc := testServer(t)
+	tracer, recorder := testTracer(t)
+
+	var resp string
+	err := CallWithCodecTraced(context.Background(), tracer, cc, "TestService.Echo", "hello", &resp)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("bad: %d spans", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "TestService.Echo" {
+		t.Fatalf("bad: %q", span.Name())
+	}
+	if span.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("bad: %v", span.SpanKind())
+	}
+	if span.Status().Code != codes.Unset {
+		t.Fatalf("bad: %v", span.Status())
+	}
+
+	attrs := spanAttrs(span)
+	if v := attrs["rpc.system"].AsString(); v != "msgpackrpc" {
+		t.Fatalf("bad: %q", v)
+	}
+	if v := attrs["rpc.service"].AsString(); v != "TestService" {
+		t.Fatalf("bad: %q", v)
+	}
+	if v := attrs["rpc.method"].AsString(); v != "Echo" {
+		t.Fatalf("bad: %q", v)
+	}
+	if v := attrs["rpc.request.size"].AsInt64(); v <= int64(len("hello")) {
+		t.Fatalf("bad: %d", v)
+	}
+	if v := attrs["rpc.response.size"].AsInt64(); v <= int64(len("hello")) {
+		t.Fatalf("bad: %d", v)
+	}
+}
+
+func TestCallWithCodecTraced_Error(t *testing.T) {
+	cc := testServer(t)
+	tracer, recorder := testTracer(t)
+
+	var resp string
+	err := CallWithCodecTraced(context.Background(), tracer, cc, "TestService.Fail", "hello", &resp)
+	if err == nil || err.Error() != "failed" {
+		t.Fatalf("err: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("bad: %d spans", len(spans))
+	}
+	span := spans[0]
+	if span.Status().Code != codes.Error || span.Status().Description != "failed" {
+		t.Fatalf("bad: %v", span.Status())
+	}
+	events := span.Events()
+	if len(events) != 1 || events[0].Name != "exception" {
+		t.Fatalf("bad: %v", events)
+	}
+
+	attrs := spanAttrs(span)
+	if _, ok := attrs["rpc.request.size"]; !ok {
+		t.Fatalf("missing request size")
+	}
+	if _, ok := attrs["rpc.response.size"]; ok {
+		t.Fatalf("unexpected response size")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"sync/atomic"
+)
+
+// Progress frames let a server report on a long running call before it
+// sends the final response. As with streamed responses, both ends must agree
+// to use them for a method, since a client that doesn't expect them would
+// take the first frame as the response.
+//
+// A progress frame is a response header for the call with a Progress field
+// set to true, followed by the progress value in place of the body. The
+// server writes zero or more of them and then the final response as usual,
+// so a response without progress frames is exactly a normal response.
+
+// ErrNoProgress is returned by SendProgress if the context doesn't come from
+// a server that can send progress frames.
+var ErrNoProgress = errors.New("msgpackrpc: progress frames are not supported here")
+
+// WriteProgress writes a progress frame for the call whose response header
+// will be r, holding the value v. The final response must still be written
+// afterwards. If the write fails, the codec is closed, as with WriteResponse.
+func (cc *MsgpackCodec) WriteProgress(r *rpc.Response, v interface{}) error {
+	header := responseHeader{
+		ServiceMethod: r.ServiceMethod,
+		Seq:           r.Seq,
+		Progress:      true,
+	}
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	body, err := cc.encodeBody(v)
+	if err != nil {
+		return err
+	}
+	if err := cc.write(&header, body); err != nil {
+		cc.closeConn()
+		return err
+	}
+	return nil
+}
+
+// progressKey is the context key for the function that sends progress frames
+// for a call being served.
+type progressKey struct{}
+
+// SendProgress sends v as a progress frame for the call whose handler was
+// given ctx by ServeConnCtx. It returns ErrNoProgress for any other context.
+func SendProgress(ctx context.Context, v interface{}) error {
+	send, ok := ctx.Value(progressKey{}).(func(interface{}) error)
+	if !ok {
+		return ErrNoProgress
+	}
+	return send(v)
+}
+
+// CallWithProgress is the same as CallWithCodec, but accepts progress frames
+// sent by the server before the final response. Each progress value is
+// decoded into an interface{} and passed to onProgress, which may be nil to
+// discard them. The codec must be a MsgpackCodec.
+func CallWithProgress(cc rpc.ClientCodec, method string, args interface{}, onProgress func(interface{}), resp interface{}) error {
+	pc, ok := cc.(*MsgpackCodec)
+	if !ok {
+		return errors.New("msgpackrpc: codec does not support progress frames")
+	}
+	request := rpc.Request{
+		Seq:           atomic.AddUint64(&nextCallSeq, 1),
+		ServiceMethod: method,
+	}
+	if err := cc.WriteRequest(&request, args); err != nil {
+		return err
+	}
+	for {
+		var response rpc.Response
+		if err := cc.ReadResponseHeader(&response); err != nil {
+			cc.Close()
+			return err
+		}
+		if !pc.isProgress {
+			return readResponseRest(nil, cc, &request, &response, resp)
+		}
+		var v interface{}
+		if err := cc.ReadResponseBody(&v); err != nil {
+			cc.Close()
+			return err
+		}
+		if onProgress != nil {
+			onProgress(v)
+		}
+	}
+}
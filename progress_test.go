@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"reflect"
+	"testing"
+)
+
+func TestCallWithProgress(t *testing.T) {
+	handler := func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error) {
+		var steps int
+		if err := dec(&steps); err != nil {
+			return nil, err
+		}
+		for i := 1; i <= steps; i++ {
+			if err := SendProgress(ctx, i); err != nil {
+				return nil, err
+			}
+		}
+		if method == "Test.Fail" {
+			return nil, errors.New("boom")
+		}
+		return "done", nil
+	}
+	clientConn, serverConn := net.Pipe()
+	go ServeConnCtx(serverConn, handler)
+	cc := NewCodec(true, true, clientConn)
+	defer cc.Close()
+
+	var progress []interface{}
+	onProgress := func(v interface{}) {
+		progress = append(progress, v)
+	}
+	var out string
+	if err := CallWithProgress(cc, "Test.Long", 3, onProgress, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "done" {
+		t.Fatalf("bad: %q", out)
+	}
+	if !reflect.DeepEqual(progress, []interface{}{int64(1), int64(2), int64(3)}) {
+		t.Fatalf("bad: %#v", progress)
+	}
+
+	// An error can follow progress frames.
+	progress = nil
+	err := CallWithProgress(cc, "Test.Fail", 2, onProgress, &out)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "boom" {
+		t.Fatalf("bad: %v", err)
+	}
+	if len(progress) != 2 {
+		t.Fatalf("bad: %#v", progress)
+	}
+
+	// No progress frames is the same as a normal response.
+	if err := CallWithProgress(cc, "Test.Long", 0, nil, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := CallWithProgress(testServer(t), "TestService.Echo", "hello", onProgress, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	if err := SendProgress(context.Background(), 1); err != ErrNoProgress {
+		t.Fatalf("bad: %v", err)
+	}
+}
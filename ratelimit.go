@@ -0,0 +1,98 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"net/rpc"
+)
+
+// Limiter is used to throttle outbound requests. It is satisfied by
+// *rate.Limiter from golang.org/x/time/rate.
+type Limiter interface {
+	// Wait blocks until a request is allowed to proceed, or returns an
+	// error if the context is cancelled first.
+	Wait(ctx context.Context) error
+}
+
+// RateLimitedCodec wraps a MsgpackCodec so that each request waits on a
+// Limiter before being written. It only exposes the rpc.ClientCodec methods,
+// so every request goes through the limiter, including those made with
+// CallWithCodecContext, CallWithCodecDeadline, CallWithRequestID and
+// CallStreaming. The context-aware calls wait on the limiter with their
+// context, so a cancelled call stops waiting.
+type RateLimitedCodec struct {
+	cc      *MsgpackCodec
+	limiter Limiter
+}
+
+// NewRateLimitedCodec returns a RateLimitedCodec that consults the limiter
+// before every request written to cc.
+func NewRateLimitedCodec(cc *MsgpackCodec, limiter Limiter) *RateLimitedCodec {
+	return &RateLimitedCodec{
+		cc:      cc,
+		limiter: limiter,
+	}
+}
+
+// WriteRequest waits on the limiter and then writes the request.
+func (rc *RateLimitedCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return rc.WriteRequestContext(context.Background(), r, body)
+}
+
+// WriteRequestContext waits on the limiter and then writes the request. If
+// the context is cancelled while waiting, nothing is written and the error
+// from the limiter is returned.
+func (rc *RateLimitedCodec) WriteRequestContext(ctx context.Context, r *rpc.Request, body interface{}) error {
+	if err := rc.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return rc.cc.WriteRequest(r, body)
+}
+
+func (rc *RateLimitedCodec) ReadResponseHeader(r *rpc.Response) error {
+	return rc.cc.ReadResponseHeader(r)
+}
+
+func (rc *RateLimitedCodec) ReadResponseBody(out interface{}) error {
+	return rc.cc.ReadResponseBody(out)
+}
+
+func (rc *RateLimitedCodec) Close() error {
+	return rc.cc.Close()
+}
+
+// IsClosed returns true once the underlying codec has been closed.
+func (rc *RateLimitedCodec) IsClosed() bool {
+	return rc.cc.IsClosed()
+}
+
+func (rc *RateLimitedCodec) connReadDeadliner() readDeadliner {
+	return rc.cc.connReadDeadliner()
+}
+
+func (rc *RateLimitedCodec) byteCounts() (read, written int) {
+	return rc.cc.byteCounts()
+}
+
+func (rc *RateLimitedCodec) writeRequestWithID(r *rpc.Request, id string, body interface{}) error {
+	if err := rc.limiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	return rc.cc.writeRequestWithID(r, id, body)
+}
+
+func (rc *RateLimitedCodec) writeRequestWithMetadata(r *rpc.Request, md map[string]string, body interface{}) error {
+	if err := rc.limiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	return rc.cc.writeRequestWithMetadata(r, md, body)
+}
+
+func (rc *RateLimitedCodec) writeRequestStream(r *rpc.Request, chunks func(send func(v interface{}) error) error) error {
+	if err := rc.limiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	return rc.cc.writeRequestStream(r, chunks)
+}
@@ -0,0 +1,173 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// tokenLimiter lets a request through for each token sent on tokens, and
+// signals on waiting each time a request starts waiting.
+type tokenLimiter struct {
+	tokens  chan struct{}
+	waiting chan struct{}
+}
+
+func newTokenLimiter() *tokenLimiter {
+	return &tokenLimiter{
+		tokens:  make(chan struct{}, 1),
+		waiting: make(chan struct{}, 1),
+	}
+}
+
+func (l *tokenLimiter) Wait(ctx context.Context) error {
+	l.waiting <- struct{}{}
+	select {
+	case <-l.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestRateLimitedCodec(t *testing.T) {
+	conn := &bufConn{}
+	limiter := newTokenLimiter()
+	rc := NewRateLimitedCodec(NewCodec(false, false, conn), limiter)
+	req := rpc.Request{ServiceMethod: "Test.Method", Seq: 1}
+
+	// A request with a token available goes straight through.
+	limiter.tokens <- struct{}{}
+	if err := rc.WriteRequest(&req, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	<-limiter.waiting
+	written := conn.w.Len()
+	if written == 0 {
+		t.Fatalf("expected request to be written")
+	}
+
+	// Without one, it's held until the limiter lets it through.
+	errCh := make(chan error, 1)
+	go func() {
+		req := rpc.Request{ServiceMethod: "Test.Method", Seq: 2}
+		errCh <- rc.WriteRequest(&req, "hello")
+	}()
+	<-limiter.waiting
+	if conn.w.Len() != written {
+		t.Fatalf("expected request to wait for the limiter")
+	}
+	limiter.tokens <- struct{}{}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conn.w.Len() != 2*written {
+		t.Fatalf("bad: %d bytes written", conn.w.Len())
+	}
+
+	// A cancelled wait writes nothing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := rc.WriteRequestContext(ctx, &req, "hello"); err != context.Canceled {
+		t.Fatalf("bad: %v", err)
+	}
+	<-limiter.waiting
+	if conn.w.Len() != 2*written {
+		t.Fatalf("bad: %d bytes written", conn.w.Len())
+	}
+}
+
+func TestRateLimitedCodec_Calls(t *testing.T) {
+	cases := map[string]func(rc *RateLimitedCodec, out *string) error{
+		"CallWithCodecContext": func(rc *RateLimitedCodec, out *string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return CallWithCodecContext(ctx, rc, "TestService.Echo", "hello", out)
+		},
+		"CallWithCodecDeadline": func(rc *RateLimitedCodec, out *string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return CallWithCodecDeadline(ctx, rc, "TestService.Echo", "hello", out)
+		},
+		"CallWithRequestID": func(rc *RateLimitedCodec, out *string) error {
+			return CallWithRequestID(rc, "TestService.Echo", "trace-1", "hello", out)
+		},
+	}
+	for name, call := range cases {
+		t.Run(name, func(t *testing.T) {
+			limiter := newTokenLimiter()
+			rc := NewRateLimitedCodec(testServer(t), limiter)
+
+			// The call is held until the limiter lets it through.
+			var out string
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- call(rc, &out)
+			}()
+			<-limiter.waiting
+			select {
+			case err := <-errCh:
+				t.Fatalf("expected call to wait for the limiter: %v", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+			limiter.tokens <- struct{}{}
+			if err := <-errCh; err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if out != "hello" {
+				t.Fatalf("bad: %q", out)
+			}
+		})
+	}
+}
+
+func TestRateLimitedCodec_CallWithCodecContextCancel(t *testing.T) {
+	conn := &bufConn{}
+	limiter := newTokenLimiter()
+	rc := NewRateLimitedCodec(NewCodec(false, false, conn), limiter)
+
+	// A call cancelled while waiting on the limiter writes nothing.
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- CallWithCodecContext(ctx, rc, "Test.Method", "hello", nil)
+	}()
+	<-limiter.waiting
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("bad: %v", err)
+	}
+	if conn.w.Len() != 0 {
+		t.Fatalf("bad: %d bytes written", conn.w.Len())
+	}
+}
+
+func TestRateLimitedCodec_CallStreaming(t *testing.T) {
+	conn := &bufConn{}
+	limiter := newTokenLimiter()
+	rc := NewRateLimitedCodec(NewCodec(false, false, conn), limiter)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- CallStreaming(rc, "Test.Method", func(send func(interface{}) error) error {
+			return send("hello")
+		}, nil)
+	}()
+	<-limiter.waiting
+	if conn.w.Len() != 0 {
+		t.Fatalf("expected request to wait for the limiter")
+	}
+	limiter.tokens <- struct{}{}
+
+	// There's no response to read, but the request was written.
+	if err := <-errCh; err == nil {
+		t.Fatalf("expected error")
+	}
+	if conn.w.Len() == 0 {
+		t.Fatalf("expected request to be written")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// ErrClientClosed is returned by a ReconnectingClient after it is closed.
+var ErrClientClosed = errors.New("msgpackrpc: client closed")
+
+// ReconnectingClient is an rpc.Client that transparently dials a new
+// connection when a call fails with a transport error: rpc.ErrShutdown,
+// io.EOF, io.ErrUnexpectedEOF or a net.Error. Any other error, such as an
+// rpc.ServerError returned by the server or a failure to decode the
+// response, is returned as-is without reconnecting.
+//
+// A call that fails with a transport error may or may not have been handled
+// by the server before the connection broke, so it is retried on the new
+// connection. Only use a ReconnectingClient for methods that are safe to
+// retry.
+type ReconnectingClient struct {
+	// MaxReconnects is the number of times a call will reconnect and
+	// retry after a transport error before giving up. Defaults to 1.
+	MaxReconnects int
+
+	// OnReconnect, if set, is called each time a new connection has been
+	// made after a failure.
+	OnReconnect func()
+
+	dial   func() (io.ReadWriteCloser, error)
+	client *rpc.Client
+	closed bool
+	lock   sync.Mutex
+}
+
+// NewReconnectingClient returns a ReconnectingClient that uses dial to make
+// its connections. The first connection is made on the first call.
+func NewReconnectingClient(dial func() (io.ReadWriteCloser, error)) *ReconnectingClient {
+	return &ReconnectingClient{
+		MaxReconnects: 1,
+		dial:          dial,
+	}
+}
+
+// Call invokes the named function, waits for it to complete, and returns
+// its error status, reconnecting and retrying on transport errors.
+func (rc *ReconnectingClient) Call(method string, args interface{}, resp interface{}) error {
+	client, err := rc.getClient(nil)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = client.Call(method, args, resp)
+		if err == nil {
+			return nil
+		}
+		if !isTransportError(err) || attempt >= rc.MaxReconnects {
+			return err
+		}
+		if client, err = rc.getClient(client); err != nil {
+			return err
+		}
+	}
+}
+
+// isTransportError returns whether err means the connection is broken, so
+// that the call should be retried on a new one.
+func isTransportError(err error) bool {
+	if errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// getClient returns the current client. If failed is not nil and is still
+// the current client, it is closed and a new connection is dialed.
+func (rc *ReconnectingClient) getClient(failed *rpc.Client) (*rpc.Client, error) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.closed {
+		return nil, ErrClientClosed
+	}
+	if rc.client != nil && rc.client != failed {
+		return rc.client, nil
+	}
+
+	reconnect := rc.client != nil
+	if reconnect {
+		rc.client.Close()
+		rc.client = nil
+	}
+	conn, err := rc.dial()
+	if err != nil {
+		return nil, err
+	}
+	rc.client = NewClient(conn)
+	if reconnect && rc.OnReconnect != nil {
+		rc.OnReconnect()
+	}
+	return rc.client, nil
+}
+
+// Close closes the current connection. Any further calls return
+// ErrClientClosed.
+func (rc *ReconnectingClient) Close() error {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.closed = true
+	if rc.client == nil {
+		return nil
+	}
+	err := rc.client.Close()
+	rc.client = nil
+	return err
+}
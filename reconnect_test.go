@@ -0,0 +1,139 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// dropServer dials connections to a server whose "Test.Drop" method echoes
+// its argument, except on the first drops connections dialed, where it
+// closes the connection instead of responding.
+type dropServer struct {
+	drops int
+
+	lock  sync.Mutex
+	dials int
+	conns []net.Conn
+}
+
+func (s *dropServer) dial() (io.ReadWriteCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dials++
+	drop := s.dials <= s.drops
+	clientConn, serverConn := net.Pipe()
+	s.conns = append(s.conns, clientConn, serverConn)
+	go ServeConnCtx(serverConn, func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error) {
+		var args string
+		if err := dec(&args); err != nil {
+			return nil, err
+		}
+		switch method {
+		case "Test.Drop":
+			if drop {
+				serverConn.Close()
+			}
+			return args, nil
+		case "Test.Fail":
+			return nil, errors.New(args)
+		}
+		return nil, errors.New("unknown method")
+	})
+	return clientConn, nil
+}
+
+func (s *dropServer) numDials() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dials
+}
+
+func (s *dropServer) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func TestReconnectingClient_ServerError(t *testing.T) {
+	s := &dropServer{}
+	defer s.close()
+	rc := NewReconnectingClient(s.dial)
+	defer rc.Close()
+	var reconnects int
+	rc.OnReconnect = func() { reconnects++ }
+
+	var resp string
+	if err := rc.Call("Test.Fail", "boom", &resp); err == nil || err.Error() != "boom" {
+		t.Fatalf("bad: %v", err)
+	}
+	if n := s.numDials(); n != 1 || reconnects != 0 {
+		t.Fatalf("bad: %d dials, %d reconnects", n, reconnects)
+	}
+}
+
+func TestReconnectingClient_Reconnect(t *testing.T) {
+	s := &dropServer{drops: 1}
+	defer s.close()
+	rc := NewReconnectingClient(s.dial)
+	defer rc.Close()
+	var reconnects int
+	rc.OnReconnect = func() { reconnects++ }
+
+	var resp string
+	if err := rc.Call("Test.Drop", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+	if n := s.numDials(); n != 2 || reconnects != 1 {
+		t.Fatalf("bad: %d dials, %d reconnects", n, reconnects)
+	}
+}
+
+func TestReconnectingClient_MaxReconnects(t *testing.T) {
+	s := &dropServer{drops: 10}
+	defer s.close()
+	rc := NewReconnectingClient(s.dial)
+	defer rc.Close()
+	rc.MaxReconnects = 2
+	var reconnects int
+	rc.OnReconnect = func() { reconnects++ }
+
+	var resp string
+	if err := rc.Call("Test.Drop", "hello", &resp); err != io.ErrUnexpectedEOF {
+		t.Fatalf("bad: %v", err)
+	}
+	if n := s.numDials(); n != 3 || reconnects != 2 {
+		t.Fatalf("bad: %d dials, %d reconnects", n, reconnects)
+	}
+}
+
+func TestReconnectingClient_Close(t *testing.T) {
+	s := &dropServer{}
+	defer s.close()
+	rc := NewReconnectingClient(s.dial)
+
+	var resp string
+	if err := rc.Call("Test.Drop", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := rc.Call("Test.Drop", "hello", &resp); err != ErrClientClosed {
+		t.Fatalf("bad: %v", err)
+	}
+	if n := s.numDials(); n != 1 {
+		t.Fatalf("bad: %d dials", n)
+	}
+}
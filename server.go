@@ -0,0 +1,491 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// ServeConnIdle runs the MessagePack-RPC server on a single connection like
+// ServeConn, but closes the connection if it has no calls in flight and no
+// new request arrives within idleTimeout. The timeout starts once the last
+// outstanding response has been written, so slow request bodies and long
+// running calls don't trip it. If conn does not support read deadlines, no
+// timeout is applied.
+func ServeConnIdle(conn io.ReadWriteCloser, idleTimeout time.Duration) {
+	cc := NewServerCodec(conn)
+	if d, ok := conn.(readDeadliner); ok && idleTimeout > 0 {
+		cc = &idleServerCodec{
+			ServerCodec: cc,
+			idle:        &idleTimer{conn: d, timeout: idleTimeout},
+		}
+	}
+	rpc.ServeCodec(cc)
+}
+
+// idleServerCodec wraps a server codec to apply a read deadline while it
+// has no calls in flight.
+type idleServerCodec struct {
+	rpc.ServerCodec
+	idle *idleTimer
+}
+
+func (c *idleServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.idle.wait(); err != nil {
+		return err
+	}
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	return c.idle.start()
+}
+
+func (c *idleServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	err := c.ServerCodec.WriteResponse(r, body)
+	c.idle.finish()
+	return err
+}
+
+// idleTimer arms a read deadline on a server connection whenever it has no
+// calls in flight. The server reads the next request header while earlier
+// calls are still being handled, so the deadline can't simply be applied
+// around each header read, or a call that runs longer than the timeout
+// would cause the connection to be closed under it.
+type idleTimer struct {
+	conn    readDeadliner
+	timeout time.Duration
+
+	lock     sync.Mutex
+	inFlight int
+}
+
+// wait is called before reading a request header. It arms the deadline if
+// there are no calls in flight, and clears it otherwise.
+func (t *idleTimer) wait() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.inFlight > 0 {
+		return t.conn.SetReadDeadline(time.Time{})
+	}
+	return t.conn.SetReadDeadline(time.Now().Add(t.timeout))
+}
+
+// start is called once a request header has been read, and clears the
+// deadline for the rest of the request.
+func (t *idleTimer) start() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.inFlight++
+	return t.conn.SetReadDeadline(time.Time{})
+}
+
+// finish is called once the response to a request has been written. If it
+// was the last call in flight, the deadline is armed for the header read
+// that is already waiting. An error setting it means the connection is
+// broken, which that read will report, so it is ignored here.
+func (t *idleTimer) finish() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.inFlight--
+	if t.inFlight == 0 {
+		t.conn.SetReadDeadline(time.Now().Add(t.timeout))
+	}
+}
+
+// ServeConnAuth runs the authenticate callback on conn before serving it
+// like ServeConn. If the callback returns an error, the connection is closed
+// without being served. The callback may read from and write to conn to
+// perform an application level handshake.
+func ServeConnAuth(conn io.ReadWriteCloser, authenticate func(conn io.ReadWriteCloser) error) error {
+	if err := authenticate(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	ServeConn(conn)
+	return nil
+}
+
+// ServeConnRecover runs the MessagePack-RPC server on a single connection
+// like ServeConn, but recovers from panics in handlers. A panicking handler
+// results in an error response to the client, and onPanic is called with the
+// method and the recovered value so it can be logged. onPanic may be nil.
+func ServeConnRecover(conn io.ReadWriteCloser, onPanic func(method string, r interface{})) {
+	serveRequests(NewCodec(true, true, conn), func(_ context.Context, rc *requestCodec) {
+		defer func() {
+			if r := recover(); r != nil {
+				if onPanic != nil {
+					onPanic(rc.req.ServiceMethod, r)
+				}
+				rc.writeError(fmt.Sprintf("rpc: panic serving %s: %v", rc.req.ServiceMethod, r))
+			}
+		}()
+		rpc.DefaultServer.ServeRequest(rc)
+	})
+}
+
+// ServeConnCtx runs a MessagePack-RPC server on a single connection,
+// calling handler for each request in its own goroutine rather than
+// dispatching to an rpc.Server. The handler is given the request's method
+// and a function to decode its arguments, and returns the response body or
+// an error to send to the client.
+//
+// The context passed to handler is cancelled once the connection fails,
+// such as when the client disconnects, so a long running handler can stop
+// working on a response no one will read. Since the connection is read
+// ahead of the handlers, a client that closes its side for writing after
+// sending its requests also cancels them. If the client sent its deadline
+// with CallWithCodecDeadline, the context also has that deadline. A handler
+// can send progress frames for a client using CallWithProgress by passing
+// its context to SendProgress. If conn is a *tls.Conn, the handler can get
+// the client's certificates from its context with PeerCertificates.
+func ServeConnCtx(conn io.ReadWriteCloser, handler func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error)) {
+	serveRequests(NewCodec(true, true, conn), func(ctx context.Context, rc *requestCodec) {
+		resp := rpc.Response{
+			ServiceMethod: rc.req.ServiceMethod,
+			Seq:           rc.req.Seq,
+		}
+		if deadline, ok := DeadlineFromMetadata(rc.metadata); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		ctx = context.WithValue(ctx, progressKey{}, func(v interface{}) error {
+			return rc.cc.WriteProgress(&resp, v)
+		})
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			ctx = context.WithValue(ctx, tlsStateKey{}, tlsConn.ConnectionState())
+		}
+		body, err := handler(ctx, rc.req.ServiceMethod, rc.ReadRequestBody)
+		if err != nil {
+			rc.writeError(err.Error())
+			return
+		}
+		rc.WriteResponse(&resp, body)
+	})
+}
+
+// Serve accepts connections on the listener and serves each one with
+// ServeConn in its own goroutine. Temporary Accept errors, such as running
+// out of file descriptors, are retried with a backoff. It returns the error
+// from Accept once the listener fails permanently, such as when it is
+// closed.
+func Serve(l net.Listener) error {
+	for {
+		conn, err := accept(l)
+		if err != nil {
+			return err
+		}
+		go ServeConn(conn)
+	}
+}
+
+const (
+	// minAcceptDelay and maxAcceptDelay bound the backoff between retries
+	// of a temporary Accept error, matching net/http.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// accept returns the next connection from the listener. Temporary errors
+// are retried after a delay that doubles from minAcceptDelay up to
+// maxAcceptDelay, so that a server that has run out of file descriptors
+// recovers once some are freed rather than stopping for good.
+func accept(l net.Listener) (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return nil, err
+		}
+		if delay == 0 {
+			delay = minAcceptDelay
+		} else {
+			delay *= 2
+		}
+		if delay > maxAcceptDelay {
+			delay = maxAcceptDelay
+		}
+		time.Sleep(delay)
+	}
+}
+
+// ServeContext is the same as Serve, but closes the listener when ctx is
+// cancelled and then returns the context's error.
+func ServeContext(ctx context.Context, l net.Listener) error {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stopCh:
+		}
+	}()
+
+	err := Serve(l)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// ServeLimited is the same as Serve, but serves at most maxConns
+// connections at once. Once the limit is reached, no more connections are
+// accepted until a served connection is closed. A maxConns below 1 would
+// never accept anything, so it is rejected with an error rather than
+// blocking forever, and the listener is left open.
+func ServeLimited(l net.Listener, maxConns int) error {
+	if maxConns < 1 {
+		return fmt.Errorf("msgpackrpc: maxConns must be at least 1, got %d", maxConns)
+	}
+	sem := make(chan struct{}, maxConns)
+	for {
+		sem <- struct{}{}
+		conn, err := accept(l)
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer func() { <-sem }()
+			ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConnTLS performs a TLS server handshake on conn using config, and
+// then serves it like ServeConn. To require and verify client certificates,
+// set config.ClientAuth to tls.RequireAndVerifyClientCert along with
+// config.ClientCAs. If the handshake fails, the connection is closed and the
+// error is returned. Handlers registered with net/rpc can't see the client's
+// certificates; use ServeConnTLSCtx for handlers that need them.
+func ServeConnTLS(conn net.Conn, config *tls.Config) error {
+	tlsConn, err := serverHandshake(conn, config)
+	if err != nil {
+		return err
+	}
+	ServeConn(tlsConn)
+	return nil
+}
+
+// ServeConnTLSCtx is the same as ServeConnTLS, but serves the connection
+// like ServeConnCtx, calling handler for each request. The handler can get
+// the client's certificates from its context with PeerCertificates.
+func ServeConnTLSCtx(conn net.Conn, config *tls.Config, handler func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error)) error {
+	tlsConn, err := serverHandshake(conn, config)
+	if err != nil {
+		return err
+	}
+	ServeConnCtx(tlsConn, handler)
+	return nil
+}
+
+// serverHandshake performs a TLS server handshake on conn, closing it if
+// the handshake fails.
+func serverHandshake(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// tlsStateKey is the context key for the TLS connection state of a call
+// being served.
+type tlsStateKey struct{}
+
+// PeerCertificates returns the certificates presented by the client for the
+// call whose handler was given ctx by ServeConnCtx, on a TLS connection.
+// The first is the client's own certificate. It returns nil if the
+// connection isn't TLS or the client didn't present a certificate.
+func PeerCertificates(ctx context.Context) []*x509.Certificate {
+	state, ok := ctx.Value(tlsStateKey{}).(tls.ConnectionState)
+	if !ok {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// ServeTLS accepts connections on the listener and serves each one with
+// ServeConnTLS in its own goroutine. Like Serve, it retries temporary Accept
+// errors and returns the error from Accept once the listener fails
+// permanently, such as when it is closed.
+func ServeTLS(l net.Listener, config *tls.Config) error {
+	for {
+		conn, err := accept(l)
+		if err != nil {
+			return err
+		}
+		go ServeConnTLS(conn, config)
+	}
+}
+
+// ServeTLSCtx is the same as ServeTLS, but serves each connection with
+// ServeConnTLSCtx, so handler can see the client's certificates.
+func ServeTLSCtx(l net.Listener, config *tls.Config, handler func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error)) error {
+	for {
+		conn, err := accept(l)
+		if err != nil {
+			return err
+		}
+		go ServeConnTLSCtx(conn, config, handler)
+	}
+}
+
+// ServeOptions configures the timeouts applied to each connection served by
+// ServeWithOptions. A zero timeout is not applied.
+type ServeOptions struct {
+	// ReadTimeout is the maximum time allowed to read a request body once
+	// its header has arrived. It is also used as the idle timeout if
+	// IdleTimeout is not set.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the maximum time allowed to write each response.
+	WriteTimeout time.Duration
+
+	// IdleTimeout is the maximum time to wait for the next request header
+	// while the connection has no calls in flight. It starts once the last
+	// outstanding response has been written, so long running calls don't
+	// trip it.
+	IdleTimeout time.Duration
+}
+
+// ServeWithOptions is the same as Serve, but applies the timeouts in opts to
+// each connection. The connection is closed when any of them fires.
+func ServeWithOptions(l net.Listener, opts ServeOptions) error {
+	for {
+		conn, err := accept(l)
+		if err != nil {
+			return err
+		}
+		go ServeConnWithOptions(conn, opts)
+	}
+}
+
+// ServeConnWithOptions is the same as ServeConn, but applies the timeouts
+// in opts to conn. The connection is closed when any of them fires.
+func ServeConnWithOptions(conn net.Conn, opts ServeOptions) {
+	rpc.ServeCodec(newTimeoutServerCodec(NewCodec(true, true, conn), conn, opts))
+}
+
+// newTimeoutServerCodec returns a timeoutServerCodec serving cc over conn.
+func newTimeoutServerCodec(cc *MsgpackCodec, conn net.Conn, opts ServeOptions) *timeoutServerCodec {
+	c := &timeoutServerCodec{
+		MsgpackCodec: cc,
+		conn:         conn,
+		opts:         opts,
+	}
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = opts.ReadTimeout
+	}
+	if idleTimeout > 0 {
+		c.idle = &idleTimer{conn: conn, timeout: idleTimeout}
+	}
+	return c
+}
+
+// timeoutServerCodec wraps a server codec to apply the deadlines from
+// ServeOptions around each read and write.
+type timeoutServerCodec struct {
+	*MsgpackCodec
+	conn net.Conn
+	opts ServeOptions
+
+	// idle applies the idle timeout, if any.
+	idle *idleTimer
+
+	// writeLock keeps the write deadline of one response from being moved
+	// by another.
+	writeLock sync.Mutex
+}
+
+func (c *timeoutServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if c.idle == nil {
+		return c.MsgpackCodec.ReadRequestHeader(r)
+	}
+	if err := c.idle.wait(); err != nil {
+		return err
+	}
+	if err := c.MsgpackCodec.ReadRequestHeader(r); err != nil {
+		if isTimeout(err) {
+			c.MsgpackCodec.Close()
+		}
+		return err
+	}
+	return c.idle.start()
+}
+
+func (c *timeoutServerCodec) ReadRequestBody(out interface{}) error {
+	return c.readWithTimeout(c.opts.ReadTimeout, func() error {
+		return c.MsgpackCodec.ReadRequestBody(out)
+	})
+}
+
+// readWithTimeout calls read with a read deadline of timeout from now, if
+// set, closing the codec if the deadline fires.
+func (c *timeoutServerCodec) readWithTimeout(timeout time.Duration, read func() error) error {
+	if timeout == 0 {
+		return read()
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := read(); err != nil {
+		if isTimeout(err) {
+			c.MsgpackCodec.Close()
+		}
+		return err
+	}
+	return c.conn.SetReadDeadline(time.Time{})
+}
+
+func (c *timeoutServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if c.idle != nil {
+		defer c.idle.finish()
+	}
+	if c.opts.WriteTimeout == 0 {
+		return c.MsgpackCodec.WriteResponse(r, body)
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout)); err != nil {
+		return err
+	}
+	// WriteResponse closes the codec if the write fails.
+	if err := c.MsgpackCodec.WriteResponse(r, body); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(time.Time{})
+}
+
+// isTimeout returns whether err is, or was caused by, a timeout. Errors from
+// the decoder report their underlying error through a Cause method.
+func isTimeout(err error) bool {
+	for err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
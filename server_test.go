@@ -0,0 +1,686 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// PanicService is registered on the default server by tests that need a
+// handler that panics.
+type PanicService struct{}
+
+func (s *PanicService) Panic(args string, resp *string) error {
+	panic(args)
+}
+
+// SleepService is registered on the default server by tests that need a
+// handler that runs for a while.
+type SleepService struct{}
+
+func (s *SleepService) Sleep(d time.Duration, resp *string) error {
+	time.Sleep(d)
+	*resp = "done"
+	return nil
+}
+
+var registerDefaultOnce sync.Once
+
+// registerDefault registers the test services on rpc.DefaultServer.
+func registerDefault(t *testing.T) {
+	registerDefaultOnce.Do(func() {
+		if err := rpc.Register(new(TestService)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := rpc.Register(new(PanicService)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := rpc.Register(new(SleepService)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	})
+}
+
+func TestServeConnIdle(t *testing.T) {
+	registerDefault(t)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	doneCh := make(chan struct{})
+	go func() {
+		ServeConnIdle(serverConn, 10*time.Millisecond)
+		close(doneCh)
+	}()
+
+	cc := NewCodec(true, true, clientConn)
+	var resp string
+	if err := CallWithCodec(cc, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// With no further requests, the server gives up on the connection.
+	waitClosed(t, clientConn)
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected server to stop")
+	}
+}
+
+func TestServeConnIdle_LongCall(t *testing.T) {
+	registerDefault(t)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go ServeConnIdle(serverConn, 10*time.Millisecond)
+
+	// While a call runs longer than the idle timeout, the connection stays
+	// open and keeps reading requests.
+	cc := NewCodec(true, true, clientConn)
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "SleepService.Sleep", Seq: 1}, 100*time.Millisecond); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "TestService.Echo", Seq: 2}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, expected := range []string{"hello", "done"} {
+		var resp rpc.Response
+		if err := cc.ReadResponseHeader(&resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out string
+		if err := cc.ReadResponseBody(&out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Error != "" || out != expected {
+			t.Fatalf("bad: %v %q", resp, out)
+		}
+	}
+
+	// The timeout starts again once every call has been answered.
+	waitClosed(t, clientConn)
+}
+
+func TestServeConnAuth(t *testing.T) {
+	registerDefault(t)
+	authenticate := func(conn io.ReadWriteCloser) error {
+		token := make([]byte, 6)
+		if _, err := io.ReadFull(conn, token); err != nil {
+			return err
+		}
+		if string(token) != "secret" {
+			return fmt.Errorf("bad token %q", token)
+		}
+		return nil
+	}
+
+	t.Run("accept", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		errCh := make(chan error, 1)
+		go func() { errCh <- ServeConnAuth(serverConn, authenticate) }()
+
+		if _, err := clientConn.Write([]byte("secret")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		cc := NewCodec(true, true, clientConn)
+		var resp string
+		if err := CallWithCodec(cc, "TestService.Echo", "hello", &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp != "hello" {
+			t.Fatalf("bad: %q", resp)
+		}
+		cc.Close()
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		errCh := make(chan error, 1)
+		go func() { errCh <- ServeConnAuth(serverConn, authenticate) }()
+
+		if _, err := clientConn.Write([]byte("wrong!")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := <-errCh; err == nil || err.Error() != `bad token "wrong!"` {
+			t.Fatalf("bad: %v", err)
+		}
+		// The connection is closed without being served.
+		var buf [1]byte
+		if _, err := clientConn.Read(buf[:]); err != io.EOF {
+			t.Fatalf("bad: %v", err)
+		}
+	})
+}
+
+func TestServeConnRecover(t *testing.T) {
+	registerDefault(t)
+	clientConn, serverConn := net.Pipe()
+
+	var lock sync.Mutex
+	var panicked []string
+	go ServeConnRecover(serverConn, func(method string, r interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		panicked = append(panicked, method)
+	})
+
+	cc := NewCodec(true, true, clientConn)
+	defer cc.Close()
+
+	var resp string
+	err := CallWithCodec(cc, "PanicService.Panic", "boom", &resp)
+	if _, ok := err.(rpc.ServerError); !ok || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The connection should still be usable after the panic.
+	if err := CallWithCodec(cc, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(panicked) != 1 || panicked[0] != "PanicService.Panic" {
+		t.Fatalf("bad: %v", panicked)
+	}
+}
+
+// tempError is a temporary net.Error, like the one returned by Accept when
+// the process runs out of file descriptors.
+type tempError struct{}
+
+func (tempError) Error() string   { return "accept: too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// fakeListener returns errs from Accept in order, then the connections sent
+// on conns until it is closed.
+type fakeListener struct {
+	lock      sync.Mutex
+	errs      []error
+	conns     chan net.Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeListener(errs ...error) *fakeListener {
+	return &fakeListener{
+		errs:    errs,
+		conns:   make(chan net.Conn),
+		closeCh: make(chan struct{}),
+	}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.lock.Unlock()
+		return nil, err
+	}
+	l.lock.Unlock()
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeCh) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServe(t *testing.T) {
+	registerDefault(t)
+
+	// Temporary errors are retried.
+	l := newFakeListener(tempError{}, tempError{}, tempError{})
+	errCh := make(chan error, 1)
+	go func() { errCh <- Serve(l) }()
+
+	clientConn, serverConn := net.Pipe()
+	l.conns <- serverConn
+	cc := NewCodec(true, true, clientConn)
+	defer cc.Close()
+	var resp string
+	if err := CallWithCodec(cc, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+
+	// Closing the listener stops it.
+	l.Close()
+	if err := <-errCh; err != net.ErrClosed {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// So does a permanent error.
+	boom := fmt.Errorf("boom")
+	if err := Serve(newFakeListener(tempError{}, boom)); err != boom {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	registerDefault(t)
+	l := newFakeListener(tempError{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- ServeContext(ctx, l) }()
+
+	clientConn, serverConn := net.Pipe()
+	l.conns <- serverConn
+	cc := NewCodec(true, true, clientConn)
+	defer cc.Close()
+	var resp string
+	if err := CallWithCodec(cc, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Cancelling the context closes the listener.
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("bad: %v", err)
+	}
+	select {
+	case <-l.closeCh:
+	default:
+		t.Fatalf("expected listener to be closed")
+	}
+
+	// A permanent error is returned as is.
+	boom := fmt.Errorf("boom")
+	if err := ServeContext(context.Background(), newFakeListener(boom)); err != boom {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestServeLimited(t *testing.T) {
+	registerDefault(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go ServeLimited(l, 1)
+
+	first, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var resp string
+	if err := first.Call("TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The second connection should wait until the first is closed.
+	second, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer second.Close()
+	call := second.Go("TestService.Echo", "hello", new(string), nil)
+	select {
+	case <-call.Done:
+		t.Fatalf("expected call to wait for a free slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			t.Fatalf("err: %v", call.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for call")
+	}
+}
+
+// waitClosed waits for the server end of conn to be closed, which shows up
+// as a read error on the client end.
+func TestServeLimited_Invalid(t *testing.T) {
+	l := newFakeListener()
+	defer l.Close()
+	for _, maxConns := range []int{0, -1} {
+		if err := ServeLimited(l, maxConns); err == nil {
+			t.Fatalf("expected error for %d", maxConns)
+		}
+	}
+}
+
+func waitClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("expected connection to be closed")
+		}
+		return
+	}
+}
+
+// deadlineConn records the deadlines set on a net.Conn.
+type deadlineConn struct {
+	net.Conn
+
+	lock           sync.Mutex
+	readDeadlines  []time.Time
+	writeDeadlines []time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadlines = append(c.readDeadlines, t)
+	c.lock.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadlines = append(c.writeDeadlines, t)
+	c.lock.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// testTimeoutServerCodec returns a timeoutServerCodec on one end of a pipe,
+// and the other end.
+func testTimeoutServerCodec(t *testing.T, opts ServeOptions) (*timeoutServerCodec, *deadlineConn, net.Conn) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	conn := &deadlineConn{Conn: serverConn}
+	return newTimeoutServerCodec(NewCodec(true, true, conn), conn, opts), conn, clientConn
+}
+
+func TestTimeoutServerCodec(t *testing.T) {
+	short := 10 * time.Millisecond
+
+	t.Run("ok", func(t *testing.T) {
+		sc, conn, clientConn := testTimeoutServerCodec(t, ServeOptions{
+			ReadTimeout:  time.Minute,
+			WriteTimeout: time.Minute,
+			IdleTimeout:  time.Minute,
+		})
+		go func() {
+			cc := NewCodec(true, true, clientConn)
+			cc.WriteRequest(&rpc.Request{ServiceMethod: "TestService.Echo", Seq: 1}, "hello")
+			var resp rpc.Response
+			cc.ReadResponseHeader(&resp)
+			cc.ReadResponseBody(nil)
+		}()
+
+		var req rpc.Request
+		if err := sc.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var body string
+		if err := sc.ReadRequestBody(&body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := sc.WriteResponse(&rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}, body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Each deadline is cleared once its operation completes, and the
+		// idle deadline is armed again once the response has been written.
+		conn.lock.Lock()
+		defer conn.lock.Unlock()
+		if len(conn.readDeadlines) != 5 || len(conn.writeDeadlines) != 2 {
+			t.Fatalf("bad: %v %v", conn.readDeadlines, conn.writeDeadlines)
+		}
+		for i, d := range conn.readDeadlines {
+			if d.IsZero() != (i%2 == 1) {
+				t.Fatalf("bad: %v", conn.readDeadlines)
+			}
+		}
+		if conn.writeDeadlines[0].IsZero() || !conn.writeDeadlines[1].IsZero() {
+			t.Fatalf("bad: %v", conn.writeDeadlines)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		sc, _, _ := testTimeoutServerCodec(t, ServeOptions{IdleTimeout: short})
+		var req rpc.Request
+		if err := sc.ReadRequestHeader(&req); !isTimeout(err) {
+			t.Fatalf("bad: %v", err)
+		}
+		if !sc.IsClosed() {
+			t.Fatalf("expected codec to be closed")
+		}
+	})
+
+	t.Run("idle during call", func(t *testing.T) {
+		sc, _, clientConn := testTimeoutServerCodec(t, ServeOptions{IdleTimeout: short})
+		go func() {
+			cc := NewCodec(true, true, clientConn)
+			cc.WriteRequest(&rpc.Request{ServiceMethod: "TestService.Echo", Seq: 1}, "hello")
+			var resp rpc.Response
+			cc.ReadResponseHeader(&resp)
+			cc.ReadResponseBody(nil)
+		}()
+		var req rpc.Request
+		if err := sc.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var body string
+		if err := sc.ReadRequestBody(&body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// While the call is in flight, waiting for the next request doesn't
+		// time out.
+		errCh := make(chan error, 1)
+		go func() {
+			var next rpc.Request
+			errCh <- sc.ReadRequestHeader(&next)
+		}()
+		select {
+		case err := <-errCh:
+			t.Fatalf("bad: %v", err)
+		case <-time.After(10 * short):
+		}
+
+		// Once it's answered, it does.
+		if err := sc.WriteResponse(&rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}, body); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		select {
+		case err := <-errCh:
+			if !isTimeout(err) {
+				t.Fatalf("bad: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected idle timeout")
+		}
+		if !sc.IsClosed() {
+			t.Fatalf("expected codec to be closed")
+		}
+	})
+
+	t.Run("idle defaults to read", func(t *testing.T) {
+		sc, _, _ := testTimeoutServerCodec(t, ServeOptions{ReadTimeout: short})
+		var req rpc.Request
+		if err := sc.ReadRequestHeader(&req); !isTimeout(err) {
+			t.Fatalf("bad: %v", err)
+		}
+		if !sc.IsClosed() {
+			t.Fatalf("expected codec to be closed")
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		sc, _, clientConn := testTimeoutServerCodec(t, ServeOptions{ReadTimeout: short, IdleTimeout: time.Minute})
+
+		// Send a header without its body.
+		go NewCodec(false, false, clientConn).Encode(&rpc.Request{ServiceMethod: "TestService.Echo", Seq: 1})
+		var req rpc.Request
+		if err := sc.ReadRequestHeader(&req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := sc.ReadRequestBody(new(string)); !isTimeout(err) {
+			t.Fatalf("bad: %v", err)
+		}
+		if !sc.IsClosed() {
+			t.Fatalf("expected codec to be closed")
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		// Nothing reads the response, so the write to the pipe blocks.
+		sc, _, _ := testTimeoutServerCodec(t, ServeOptions{WriteTimeout: short})
+		if err := sc.WriteResponse(&rpc.Response{ServiceMethod: "TestService.Echo", Seq: 1}, "hello"); !isTimeout(err) {
+			t.Fatalf("bad: %v", err)
+		}
+		if !sc.IsClosed() {
+			t.Fatalf("expected codec to be closed")
+		}
+	})
+}
+
+func TestServeWithOptions(t *testing.T) {
+	registerDefault(t)
+	l := newFakeListener(tempError{})
+	errCh := make(chan error, 1)
+	go func() { errCh <- ServeWithOptions(l, ServeOptions{IdleTimeout: 10 * time.Millisecond}) }()
+
+	// Connections are served with the options applied, so an idle one is
+	// closed by the server.
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	l.conns <- serverConn
+	waitClosed(t, clientConn)
+
+	l.Close()
+	if err := <-errCh; err != net.ErrClosed {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestServeConnWithOptions_LongCall(t *testing.T) {
+	registerDefault(t)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go ServeConnWithOptions(serverConn, ServeOptions{IdleTimeout: 10 * time.Millisecond})
+
+	// A call that runs longer than the idle timeout doesn't stop the
+	// connection from reading the next request.
+	cc := NewCodec(true, true, clientConn)
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "SleepService.Sleep", Seq: 1}, 100*time.Millisecond); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "TestService.Echo", Seq: 2}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, expected := range []string{"hello", "done"} {
+		var resp rpc.Response
+		if err := cc.ReadResponseHeader(&resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out string
+		if err := cc.ReadResponseBody(&out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Error != "" || out != expected {
+			t.Fatalf("bad: %v %q", resp, out)
+		}
+	}
+	waitClosed(t, clientConn)
+}
+
+func TestServeConnCtx(t *testing.T) {
+	cancelled := make(chan string, 1)
+	handler := func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error) {
+		switch method {
+		case "Test.Echo":
+			var in string
+			if err := dec(&in); err != nil {
+				return nil, err
+			}
+			return in, nil
+		case "Test.Block":
+			<-ctx.Done()
+			cancelled <- method
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		ServeConnCtx(serverConn, handler)
+	}()
+	cc := NewCodec(true, true, clientConn)
+
+	var out string
+	if err := CallWithCodec(cc, "Test.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("bad: %q", out)
+	}
+	err := CallWithCodec(cc, "Test.Missing", "hello", &out)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "unknown method Test.Missing" {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Disconnecting while a handler is running cancels its context.
+	if err := cc.WriteRequest(&rpc.Request{ServiceMethod: "Test.Block", Seq: 1}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-cancelled:
+		t.Fatalf("cancelled before disconnect")
+	case <-time.After(10 * time.Millisecond):
+	}
+	cc.Close()
+	select {
+	case method := <-cancelled:
+		if method != "Test.Block" {
+			t.Fatalf("bad: %s", method)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected handler to be cancelled")
+	}
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected server to exit")
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"errors"
+	"net/rpc"
+	"sync/atomic"
+)
+
+// Streamed responses let a server send a large result as a sequence of
+// items that the client processes one at a time, rather than as a single
+// body. This is outside of the net/rpc protocol, so both ends must agree to
+// use it for a method, and it can't be used with rpc.Server or rpc.Client.
+//
+// A streamed response is a normal response header followed, in place of
+// the body, by zero or more items and an end marker. Each item is written as
+// the msgpack value true followed by the item. The end marker is the value
+// false followed by an error string, which is empty if the stream completed
+// successfully.
+//
+// Streamed requests work the same way in the other direction, letting a
+// client send a large argument as a sequence of chunks with CallStreaming.
+// The request header is followed, in place of the body, by the chunks and an
+// end marker, which the server reads with NextRequestChunk.
+
+// ErrStreamClosed is returned when sending on a ResponseStream that has
+// already been closed.
+var ErrStreamClosed = errors.New("msgpackrpc: response stream is closed")
+
+// ResponseStream writes the items of a streamed response. It holds the
+// codec's write lock from when it is created until it is closed, so other
+// responses can't be written in the meantime, and it must always be closed.
+// The request only stops counting towards InFlight once the stream is
+// closed. If a write fails, the codec is closed, as with WriteResponse. It
+// isn't safe for concurrent use.
+//
+// Since handlers called by rpc.Server don't have access to the codec, a
+// ResponseStream is for servers that run their own loop over
+// ReadRequestHeader and ReadRequestBody, and write the response for a
+// streaming method with one instead of calling WriteResponse.
+type ResponseStream struct {
+	cc     *MsgpackCodec
+	err    error
+	closed bool
+}
+
+// NewResponseStream writes the response header r and returns a
+// ResponseStream for sending the items of the response.
+func (cc *MsgpackCodec) NewResponseStream(r *rpc.Response) (*ResponseStream, error) {
+	cc.writeLock.Lock()
+	if err := cc.write(r); err != nil {
+		cc.closeConn()
+		cc.writeLock.Unlock()
+		cc.inFlight.Add(-1)
+		return nil, err
+	}
+	return &ResponseStream{cc: cc}, nil
+}
+
+// Send writes an item of the response and flushes it. Once a send has
+// failed, all further sends return the same error.
+func (s *ResponseStream) Send(v interface{}) error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if s.err = s.cc.write(true, v); s.err != nil {
+		s.cc.closeConn()
+	}
+	return s.err
+}
+
+// Close ends the stream successfully by writing the end marker, and
+// releases the codec's write lock. It returns the error from a failed send,
+// if any, in which case the end marker isn't written.
+func (s *ResponseStream) Close() error {
+	return s.CloseWithError(nil)
+}
+
+// CloseWithError is the same as Close, but sends err to the client in the
+// end marker. A nil err ends the stream successfully.
+func (s *ResponseStream) CloseWithError(err error) error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	s.closed = true
+	defer s.cc.inFlight.Add(-1)
+	defer s.cc.writeLock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+	if err := s.cc.write(false, msg); err != nil {
+		s.cc.closeConn()
+		return err
+	}
+	return nil
+}
+
+// WriteResponseStream writes the response header r and then calls items,
+// which sends each item of the response with send. Each item is flushed as
+// it is sent. If items returns an error, it is sent to the client in the
+// end marker. Other responses can't be written until the stream has ended.
+func (cc *MsgpackCodec) WriteResponseStream(r *rpc.Response, items func(send func(v interface{}) error) error) error {
+	s, err := cc.NewResponseStream(r)
+	if err != nil {
+		return err
+	}
+	return s.CloseWithError(items(s.Send))
+}
+
+// NextResponseItem reads the next item of a streamed response into v. It
+// returns false once the end of the stream has been reached, along with an
+// rpc.ServerError if the server ended the stream with an error. It must be
+// called after ReadResponseHeader for a method that streams its response,
+// until it returns false.
+func (cc *MsgpackCodec) NextResponseItem(v interface{}) (bool, error) {
+	var more bool
+	if err := cc.readAt(readBody, readBody, &more); err != nil {
+		return false, err
+	}
+	if !more {
+		var msg string
+		if err := cc.readAt(readBody, readHeader, &msg); err != nil {
+			return false, err
+		}
+		if msg != "" {
+			return false, rpc.ServerError(msg)
+		}
+		return false, nil
+	}
+	if err := cc.readAt(readBody, readBody, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// requestStreamer is implemented by codecs that can write streamed requests.
+type requestStreamer interface {
+	writeRequestStream(r *rpc.Request, chunks func(send func(v interface{}) error) error) error
+}
+
+// CallStreaming is the same as CallWithCodec, but sends the argument as a
+// sequence of chunks rather than a single body, so that a large argument
+// doesn't need to be held in memory. It calls chunks, which sends each chunk
+// with send, and then reads the response into resp. If chunks returns an
+// error, it is sent to the server in the end marker, the response is read
+// to keep the stream aligned, and the error is returned. The codec must be
+// a MsgpackCodec.
+func CallStreaming(cc rpc.ClientCodec, method string, chunks func(send func(interface{}) error) error, resp interface{}) error {
+	s, ok := cc.(requestStreamer)
+	if !ok {
+		return errors.New("msgpackrpc: codec does not support streamed requests")
+	}
+	request := rpc.Request{
+		Seq:           atomic.AddUint64(&nextCallSeq, 1),
+		ServiceMethod: method,
+	}
+	var chunkErr error
+	err := s.writeRequestStream(&request, func(send func(v interface{}) error) error {
+		chunkErr = chunks(send)
+		return chunkErr
+	})
+	if err != nil {
+		return err
+	}
+	err = readResponse(nil, cc, &request, resp)
+	if chunkErr != nil {
+		return chunkErr
+	}
+	return err
+}
+
+// writeRequestStream writes the request header r and then the chunks sent
+// by chunks, followed by the end marker. An error returned by chunks is
+// sent in the end marker rather than returned. If a write fails, the codec
+// is closed, as with WriteRequest.
+func (cc *MsgpackCodec) writeRequestStream(r *rpc.Request, chunks func(send func(v interface{}) error) error) error {
+	if err := cc.validateMethod(r.ServiceMethod); err != nil {
+		return err
+	}
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+	if err := cc.write(r); err != nil {
+		cc.closeConn()
+		return err
+	}
+
+	var writeErr error
+	err := chunks(func(v interface{}) error {
+		if writeErr = cc.write(true, v); writeErr != nil {
+			return writeErr
+		}
+		return nil
+	})
+	if writeErr != nil {
+		cc.closeConn()
+		return writeErr
+	}
+
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+	if err := cc.write(false, msg); err != nil {
+		cc.closeConn()
+		return err
+	}
+	return nil
+}
+
+// NextRequestChunk reads the next chunk of a streamed request into v. It
+// returns false once the end of the stream has been reached, along with an
+// error if the client ended the stream with one. It must be called after
+// ReadRequestHeader for a method that streams its argument, until it returns
+// false, and before writing the response.
+func (cc *MsgpackCodec) NextRequestChunk(v interface{}) (bool, error) {
+	var more bool
+	if err := cc.readAt(readBody, readBody, &more); err != nil {
+		return false, err
+	}
+	if !more {
+		var msg string
+		if err := cc.readAt(readBody, readHeader, &msg); err != nil {
+			return false, err
+		}
+		if msg != "" {
+			return false, errors.New(msg)
+		}
+		return false, nil
+	}
+	if err := cc.readAt(readBody, readBody, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,268 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func TestCodec_ResponseStream(t *testing.T) {
+	conn := &bufConn{}
+	server := NewCodec(true, true, conn)
+	resp := rpc.Response{ServiceMethod: "Test.List", Seq: 1}
+	err := server.WriteResponseStream(&resp, func(send func(v interface{}) error) error {
+		for i := 0; i < 3; i++ {
+			if err := send(testArgs{Count: i}); err != nil {
+				return err
+			}
+		}
+		return errors.New("out of items")
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client := NewCodec(true, true, &bufConn{r: &conn.w})
+	var header rpc.Response
+	if err := client.ReadResponseHeader(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var count int
+	for {
+		var item testArgs
+		more, err := client.NextResponseItem(&item)
+		if !more {
+			if _, ok := err.(rpc.ServerError); !ok || err.Error() != "out of items" {
+				t.Fatalf("bad: %v", err)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if item.Count != count {
+			t.Fatalf("bad: %#v", item)
+		}
+		count++
+	}
+	if count != 3 {
+		t.Fatalf("bad: %d", count)
+	}
+}
+
+func TestResponseStream(t *testing.T) {
+	conn := &bufConn{}
+	server := NewCodec(true, true, conn)
+	s, err := server.NewResponseStream(&rpc.Response{ServiceMethod: "Test.List", Seq: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.Send(testArgs{Count: i}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.Send(testArgs{}); err != ErrStreamClosed {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The write lock has been released.
+	if err := server.WriteResponse(&rpc.Response{ServiceMethod: "Test.Echo", Seq: 2}, "hello"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client := NewCodec(true, true, &bufConn{r: &conn.w})
+	var header rpc.Response
+	if err := client.ReadResponseHeader(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var count int
+	for {
+		var item testArgs
+		more, err := client.NextResponseItem(&item)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !more {
+			break
+		}
+		if item.Count != count {
+			t.Fatalf("bad: %#v", item)
+		}
+		count++
+	}
+	if count != 3 {
+		t.Fatalf("bad: %d", count)
+	}
+
+	var out string
+	if err := CallWithCodec(client, "Test.Echo", "hello", &out); err != nil || out != "hello" {
+		t.Fatalf("bad: %v %q", err, out)
+	}
+}
+
+// toggleFailConn fails writes once fail is set.
+type toggleFailConn struct {
+	bufConn
+	fail bool
+}
+
+func (c *toggleFailConn) Write(p []byte) (int, error) {
+	if c.fail {
+		return 0, errors.New("write failed")
+	}
+	return c.bufConn.Write(p)
+}
+
+func TestResponseStream_WriteError(t *testing.T) {
+	// A failed send closes the codec.
+	conn := &toggleFailConn{}
+	server := NewCodec(true, true, conn)
+	s, err := server.NewResponseStream(&rpc.Response{ServiceMethod: "Test.List", Seq: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.fail = true
+	if err := s.Send(testArgs{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if !server.IsClosed() || !conn.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+	if err := s.Close(); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// So does failing to write the end marker.
+	conn = &toggleFailConn{}
+	server = NewCodec(true, true, conn)
+	s, err = server.NewResponseStream(&rpc.Response{ServiceMethod: "Test.List", Seq: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.fail = true
+	if err := s.CloseWithError(errors.New("out of items")); err == nil {
+		t.Fatalf("expected error")
+	}
+	if !server.IsClosed() || !conn.closed {
+		t.Fatalf("expected codec to be closed")
+	}
+}
+
+func TestResponseStream_InFlight(t *testing.T) {
+	conn := &bufConn{}
+	client := NewCodec(true, true, conn)
+	req := rpc.Request{ServiceMethod: "Test.List", Seq: 1}
+	if err := client.WriteRequest(&req, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	server := NewCodec(true, true, &bufConn{r: &conn.w})
+	var header rpc.Request
+	if err := server.ReadRequestHeader(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := server.ReadRequestBody(nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := server.InFlight(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	s, err := server.NewResponseStream(&rpc.Response{ServiceMethod: header.ServiceMethod, Seq: header.Seq})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.Send(testArgs{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := server.InFlight(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := server.InFlight(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestCallStreaming(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// The server sums the chunks of each request, and fails the call if the
+	// client ended the stream with an error.
+	go func() {
+		server := NewCodec(true, true, serverConn)
+		for {
+			var req rpc.Request
+			if err := server.ReadRequestHeader(&req); err != nil {
+				return
+			}
+			var sum int
+			var streamErr error
+			for {
+				var chunk testArgs
+				more, err := server.NextRequestChunk(&chunk)
+				if !more {
+					streamErr = err
+					break
+				}
+				if err != nil {
+					return
+				}
+				sum += chunk.Count
+			}
+			resp := rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}
+			if streamErr != nil {
+				resp.Error = streamErr.Error()
+			}
+			server.WriteResponse(&resp, sum)
+		}
+	}()
+
+	client := NewCodec(true, true, clientConn)
+	var sum int
+	err := CallStreaming(client, "Test.Sum", func(send func(interface{}) error) error {
+		for i := 1; i <= 4; i++ {
+			if err := send(testArgs{Count: i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, &sum)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sum != 10 {
+		t.Fatalf("bad: %d", sum)
+	}
+
+	err = CallStreaming(client, "Test.Sum", func(send func(interface{}) error) error {
+		send(testArgs{Count: 1})
+		return errors.New("read failed")
+	}, &sum)
+	if err == nil || err.Error() != "read failed" {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The stream is still aligned after a failed upload.
+	err = CallStreaming(client, "Test.Sum", func(send func(interface{}) error) error {
+		return send(testArgs{Count: 5})
+	}, &sum)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sum != 5 {
+		t.Fatalf("bad: %d", sum)
+	}
+}
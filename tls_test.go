@@ -0,0 +1,136 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate for localhost with the given
+// common name, and a pool that trusts it.
+func selfSigned(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	registerDefault(t)
+	serverCert, serverPool := selfSigned(t, "server")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go ServeTLS(l, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: serverPool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cc := NewCodec(true, true, conn)
+	defer cc.Close()
+	var resp string
+	if err := CallWithCodec(cc, "TestService.Echo", "hello", &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp != "hello" {
+		t.Fatalf("bad: %q", resp)
+	}
+}
+
+func TestServeConnTLS_HandshakeError(t *testing.T) {
+	serverCert, _ := selfSigned(t, "server")
+	_, otherPool := selfSigned(t, "other")
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	// The client doesn't trust the server's certificate.
+	go tls.Client(clientConn, &tls.Config{RootCAs: otherPool, ServerName: "localhost"}).Handshake()
+	if err := ServeConnTLS(serverConn, &tls.Config{Certificates: []tls.Certificate{serverCert}}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestServeTLSCtx_PeerCertificates(t *testing.T) {
+	serverCert, serverPool := selfSigned(t, "server")
+	clientCert, clientPool := selfSigned(t, "client")
+	handler := func(ctx context.Context, method string, dec func(interface{}) error) (interface{}, error) {
+		if err := dec(nil); err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, cert := range PeerCertificates(ctx) {
+			names = append(names, cert.Subject.CommonName)
+		}
+		return names, nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go ServeTLSCtx(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}, handler)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      serverPool,
+		ServerName:   "localhost",
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cc := NewCodec(true, true, conn)
+	defer cc.Close()
+	var names []string
+	if err := CallWithCodec(cc, "Test.Peer", nil, &names); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(names) != 1 || names[0] != "client" {
+		t.Fatalf("bad: %v", names)
+	}
+
+	if certs := PeerCertificates(context.Background()); certs != nil {
+		t.Fatalf("bad: %v", certs)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"net/rpc"
+	"sync"
+)
+
+// TranscriptEntry records a single call made through a TranscriptCodec.
+type TranscriptEntry struct {
+	Method string
+	Seq    uint64
+	Args   interface{}
+
+	// Resp is the value the response body was decoded into, if any.
+	Resp interface{}
+
+	// Err is the first error seen for the call, either from the transport
+	// or an rpc.ServerError returned by the server.
+	Err error
+}
+
+// TranscriptCodec wraps an rpc.ClientCodec and records every request
+// written and response read through it. This is useful when debugging
+// protocol issues. Responses are matched to their requests by sequence
+// number.
+type TranscriptCodec struct {
+	rpc.ClientCodec
+
+	entries []TranscriptEntry
+	index   map[uint64]int
+	current int
+	lock    sync.Mutex
+}
+
+// NewTranscriptCodec returns a TranscriptCodec that records calls made
+// through cc.
+func NewTranscriptCodec(cc rpc.ClientCodec) *TranscriptCodec {
+	return &TranscriptCodec{
+		ClientCodec: cc,
+		index:       make(map[uint64]int),
+		current:     -1,
+	}
+}
+
+func (tc *TranscriptCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	err := tc.ClientCodec.WriteRequest(r, body)
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.index[r.Seq] = len(tc.entries)
+	tc.entries = append(tc.entries, TranscriptEntry{
+		Method: r.ServiceMethod,
+		Seq:    r.Seq,
+		Args:   body,
+		Err:    err,
+	})
+	return err
+}
+
+func (tc *TranscriptCodec) ReadResponseHeader(r *rpc.Response) error {
+	err := tc.ClientCodec.ReadResponseHeader(r)
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if err != nil {
+		tc.current = -1
+		tc.entries = append(tc.entries, TranscriptEntry{Err: err})
+		return err
+	}
+	i, ok := tc.index[r.Seq]
+	if !ok {
+		i = len(tc.entries)
+		tc.entries = append(tc.entries, TranscriptEntry{
+			Method: r.ServiceMethod,
+			Seq:    r.Seq,
+		})
+	}
+	delete(tc.index, r.Seq)
+	tc.current = i
+	if r.Error != "" {
+		tc.setErr(i, rpc.ServerError(r.Error))
+	}
+	return nil
+}
+
+func (tc *TranscriptCodec) ReadResponseBody(body interface{}) error {
+	err := tc.ClientCodec.ReadResponseBody(body)
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if tc.current < 0 {
+		if err != nil {
+			tc.entries = append(tc.entries, TranscriptEntry{Err: err})
+		}
+		return err
+	}
+	tc.entries[tc.current].Resp = body
+	tc.setErr(tc.current, err)
+	tc.current = -1
+	return err
+}
+
+// setErr records err against the entry at i if it doesn't already have one.
+func (tc *TranscriptCodec) setErr(i int, err error) {
+	if err != nil && tc.entries[i].Err == nil {
+		tc.entries[i].Err = err
+	}
+}
+
+// Transcript returns a copy of the entries recorded so far, in the order
+// the requests were written.
+func (tc *TranscriptCodec) Transcript() []TranscriptEntry {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	out := make([]TranscriptEntry, len(tc.entries))
+	copy(out, tc.entries)
+	return out
+}
@@ -0,0 +1,50 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package msgpackrpc
+
+import (
+	"net/rpc"
+	"testing"
+)
+
+func TestTranscriptCodec(t *testing.T) {
+	tc := NewTranscriptCodec(testServer(t))
+	caller := NewCallerSeq(1)
+
+	var out string
+	if err := caller.CallWithCodec(tc, "TestService.Echo", "hello", &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var failed string
+	if err := caller.CallWithCodec(tc, "TestService.Fail", "boom", &failed); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	entries := tc.Transcript()
+	if len(entries) != 2 {
+		t.Fatalf("bad: %#v", entries)
+	}
+
+	echo := entries[0]
+	if echo.Method != "TestService.Echo" || echo.Seq != 1 || echo.Args != "hello" || echo.Err != nil {
+		t.Fatalf("bad: %#v", echo)
+	}
+	if resp, ok := echo.Resp.(*string); !ok || resp != &out || *resp != "hello" {
+		t.Fatalf("bad: %#v", echo.Resp)
+	}
+
+	fail := entries[1]
+	if fail.Method != "TestService.Fail" || fail.Seq != 2 || fail.Args != "boom" {
+		t.Fatalf("bad: %#v", fail)
+	}
+	if fail.Err != rpc.ServerError("boom") {
+		t.Fatalf("bad: %#v", fail.Err)
+	}
+
+	// The transcript is a copy.
+	entries[0].Method = "changed"
+	if tc.Transcript()[0].Method != "TestService.Echo" {
+		t.Fatalf("expected transcript to be copied")
+	}
+}